@@ -0,0 +1,158 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinMultiplier  = 0.1
+	defaultRecoveryPeriod = 30 * time.Second
+
+	// successRecovery is the fraction of the multiplier range regained by
+	// every success.
+	successRecovery = 0.1
+)
+
+// StrategyAdaptiveWeight is a Strategy that selects endpoints by smooth
+// weighted round-robin, scaling the Weight of each endpoint by a health
+// multiplier between MinMultiplier and 1. Every failure reported through
+// LoadBalancer.ReportResult halves the multiplier of its endpoint, while
+// successes and the passing of time restore it. Unlike ejection, a failing
+// endpoint keeps receiving a small share of traffic. Use a pointer; the
+// zero value is ready to use.
+type StrategyAdaptiveWeight struct {
+	// MinMultiplier is the lowest health multiplier, between 0 and 1. If
+	// zero, 0.1 is used.
+	MinMultiplier float64
+
+	// RecoveryPeriod is the time a multiplier takes to recover from
+	// MinMultiplier to 1 without further failures. If zero, 30 seconds is
+	// used.
+	RecoveryPeriod time.Duration
+
+	mu      sync.Mutex
+	now     func() time.Time // the LoadBalancer clock, set by New
+	health  map[string]adaptiveHealth
+	current map[string]float64 // smooth weighted round-robin state
+}
+
+// adaptiveHealth is the multiplier of an endpoint as of a point in time,
+// from which it recovers linearly.
+type adaptiveHealth struct {
+	multiplier float64
+	at         time.Time
+}
+
+// Pick returns the next endpoint by smooth weighted round-robin over the
+// weights of the endpoints scaled by their health multipliers.
+func (s *StrategyAdaptiveWeight) Pick(endpoints []Endpoint) (Endpoint, error) {
+	if len(endpoints) == 0 {
+		return Endpoint{}, ErrNoEndpoints
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		s.current = make(map[string]float64)
+	}
+
+	now := s.clock()
+	live := make(map[string]bool, len(endpoints))
+	total := 0.0
+	best := -1
+	for i, ep := range endpoints {
+		key := ep.key()
+		live[key] = true
+		w := float64(ep.Weight) * s.multiplier(key, now)
+		s.current[key] += w
+		total += w
+		if best < 0 || s.current[key] > s.current[endpoints[best].key()] {
+			best = i
+		}
+	}
+	for key := range s.current {
+		if !live[key] {
+			delete(s.current, key)
+		}
+	}
+	for key := range s.health {
+		if !live[key] {
+			delete(s.health, key)
+		}
+	}
+
+	endpoint := endpoints[best]
+	s.current[endpoint.key()] -= total
+	return endpoint, nil
+}
+
+// ReportResult lowers the multiplier of endpoint on failure and raises it
+// on success.
+func (s *StrategyAdaptiveWeight) ReportResult(endpoint Endpoint, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.health == nil {
+		s.health = make(map[string]adaptiveHealth)
+	}
+
+	key := endpoint.key()
+	now := s.clock()
+	m := s.multiplier(key, now)
+	if err != nil {
+		m /= 2
+	} else {
+		m += successRecovery * (1 - s.minMultiplier())
+	}
+	if m < s.minMultiplier() {
+		m = s.minMultiplier()
+	}
+	if m >= 1 {
+		delete(s.health, key)
+		return
+	}
+	s.health[key] = adaptiveHealth{m, now}
+}
+
+// multiplier returns the health multiplier of the endpoint with the given
+// key at now. s.mu must be held.
+func (s *StrategyAdaptiveWeight) multiplier(key string, now time.Time) float64 {
+	h, ok := s.health[key]
+	if !ok {
+		return 1
+	}
+	period := s.RecoveryPeriod
+	if period <= 0 {
+		period = defaultRecoveryPeriod
+	}
+	m := h.multiplier + (1-s.minMultiplier())*float64(now.Sub(h.at))/float64(period)
+	if m > 1 {
+		return 1
+	}
+	return m
+}
+
+// setClock makes s read the time through now.
+func (s *StrategyAdaptiveWeight) setClock(now func() time.Time) {
+	s.mu.Lock()
+	s.now = now
+	s.mu.Unlock()
+}
+
+// clock returns the current time. s.mu must be held.
+func (s *StrategyAdaptiveWeight) clock() time.Time {
+	if s.now == nil {
+		return time.Now()
+	}
+	return s.now()
+}
+
+func (s *StrategyAdaptiveWeight) minMultiplier() float64 {
+	if s.MinMultiplier <= 0 || s.MinMultiplier > 1 {
+		return defaultMinMultiplier
+	}
+	return s.MinMultiplier
+}
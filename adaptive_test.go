@@ -0,0 +1,71 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// share returns the share of n selections by lb that went to host.
+func share(t *testing.T, lb *LoadBalancer, host string, n int) float64 {
+	t.Helper()
+	hits := 0
+	for i := 0; i < n; i++ {
+		got, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Host == host {
+			hits++
+		}
+	}
+	return float64(hits) / float64(n)
+}
+
+func TestAdaptiveWeightDecayAndRecovery(t *testing.T) {
+	a, b := ep("10.0.0.1", "80"), ep("10.0.0.2", "80")
+	failed := errors.New("failed")
+
+	lb := newStatic(&Config{Strategy: &StrategyAdaptiveWeight{RecoveryPeriod: time.Hour}}, a, b)
+	if got := share(t, lb, a.Host, 100); got != 0.5 {
+		t.Fatalf("share of a healthy endpoint = %v, want 0.5", got)
+	}
+	for i := 0; i < 3; i++ {
+		lb.ReportResult(a, time.Millisecond, failed)
+	}
+	// A multiplier of 1/8 against 1 gives a share of 1/9.
+	if got := share(t, lb, a.Host, 90); got < 0.1 || got > 0.12 {
+		t.Fatalf("share after 3 failures = %v, want about 0.11", got)
+	}
+	for i := 0; i < 5; i++ {
+		lb.ReportResult(a, time.Millisecond, nil)
+	}
+	if got := share(t, lb, a.Host, 100); got < 0.3 || got > 0.4 {
+		t.Fatalf("share after 5 successes = %v, want about 0.36", got)
+	}
+	for i := 0; i < 5; i++ {
+		lb.ReportResult(a, time.Millisecond, nil)
+	}
+	if got := share(t, lb, a.Host, 100); got != 0.5 {
+		t.Fatalf("share after 10 successes = %v, want 0.5", got)
+	}
+
+	// Without further results the multiplier recovers over RecoveryPeriod.
+	clock := newFakeClock()
+	lb = newStatic(&Config{Strategy: &StrategyAdaptiveWeight{RecoveryPeriod: time.Minute}}, a, b)
+	lb.now = clock.Now
+	for i := 0; i < 3; i++ {
+		lb.ReportResult(a, time.Millisecond, failed)
+	}
+	if got := share(t, lb, a.Host, 90); got > 0.12 {
+		t.Fatalf("share before RecoveryPeriod = %v, want about 0.11", got)
+	}
+	clock.Advance(time.Minute)
+	if got := share(t, lb, a.Host, 100); got != 0.5 {
+		t.Fatalf("share after RecoveryPeriod = %v, want 0.5", got)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes how long to wait before retrying a failed Kubernetes API
+// call. Backoff implementations must be safe for concurrent use as the watch
+// and reconciliation loops share a single Backoff.
+type Backoff interface {
+	// Next returns the delay before the given retry attempt. Attempts are
+	// counted from 1 and restart after every successful call.
+	Next(attempt int) time.Duration
+
+	// Reset is called after a successful call and clears any state the
+	// Backoff keeps between attempts.
+	Reset()
+}
+
+// ConstantBackoff waits the same Delay before every retry.
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+// Next returns b.Delay.
+func (b *ConstantBackoff) Next(attempt int) time.Duration {
+	return b.Delay
+}
+
+// Reset is a no-op.
+func (b *ConstantBackoff) Reset() {}
+
+// ExponentialBackoff doubles the delay after every failed attempt, starting
+// at Base. If Max is positive the delay never exceeds Max. If Jitter is set
+// a random delay between zero and the computed one is used instead, so
+// that clients failing together do not retry in lockstep.
+type ExponentialBackoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter bool
+}
+
+// Next returns Base * 2^(attempt-1), capped at Max, or a random delay up to
+// it if Jitter is set.
+func (b *ExponentialBackoff) Next(attempt int) time.Duration {
+	d := b.Base
+	for i := 1; i < attempt; i++ {
+		if d > (1<<63-1)/2 || (b.Max > 0 && d >= b.Max) {
+			break
+		}
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter && d > 0 {
+		d = time.Duration(rand.Int63n(int64(d) + 1))
+	}
+	return d
+}
+
+// Reset is a no-op.
+func (b *ExponentialBackoff) Reset() {}
@@ -0,0 +1,133 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A recordingBackoff returns delays from a fixed list and records the
+// attempts it was asked about.
+type recordingBackoff struct {
+	mu       sync.Mutex
+	delays   []time.Duration
+	attempts []int
+	resets   int
+}
+
+func (b *recordingBackoff) Next(attempt int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts = append(b.attempts, attempt)
+	return b.delays[(attempt-1)%len(b.delays)]
+}
+
+func (b *recordingBackoff) Reset() {
+	b.mu.Lock()
+	b.resets++
+	b.mu.Unlock()
+}
+
+func TestWatchUsesBackoff(t *testing.T) {
+	const failures = 3
+	var mu sync.Mutex
+	var times []time.Time
+	connected := make(chan struct{})
+
+	api := newFakeAPI(t, endpointsObject("1"))
+	api.setWatch(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		n := len(times)
+		mu.Unlock()
+		if n <= failures {
+			writeStatus(w, http.StatusServiceUnavailable, "ServiceUnavailable", "unavailable")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		if n == failures+1 {
+			close(connected)
+		}
+		<-r.Context().Done()
+	})
+
+	backoff := &recordingBackoff{delays: []time.Duration{
+		20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond,
+	}}
+	config := api.config()
+	config.Backoff = backoff
+	lb := New(config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.watch(ctx, make(chan watchUpdate, 1))
+	}()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not reconnect")
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		backoff.mu.Lock()
+		resets := backoff.resets
+		backoff.mu.Unlock()
+		if resets > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	backoff.mu.Lock()
+	defer backoff.mu.Unlock()
+	if len(backoff.attempts) != failures {
+		t.Fatalf("Backoff.Next called for attempts %v, want 1 to %d", backoff.attempts, failures)
+	}
+	for i, attempt := range backoff.attempts {
+		if attempt != i+1 {
+			t.Fatalf("Backoff.Next called for attempts %v, want 1 to %d in order", backoff.attempts, failures)
+		}
+		if waited := times[i+1].Sub(times[i]); waited < backoff.delays[i] {
+			t.Errorf("waited %v after attempt %d, want at least %v", waited, attempt, backoff.delays[i])
+		}
+	}
+	if backoff.resets != 1 {
+		t.Errorf("Backoff.Reset called %d times, want once after connecting", backoff.resets)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := &ExponentialBackoff{Base: time.Second, Max: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := b.Next(i + 1); got != w {
+			t.Errorf("Next(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+
+	b.Jitter = true
+	for i := 0; i < 100; i++ {
+		if got := b.Next(3); got < 0 || got > 4*time.Second {
+			t.Fatalf("Next(3) with jitter = %v, want between 0 and 4s", got)
+		}
+	}
+}
+
+func TestConstantBackoff(t *testing.T) {
+	b := &ConstantBackoff{Delay: time.Second}
+	for attempt := 1; attempt <= 3; attempt++ {
+		if got := b.Next(attempt); got != time.Second {
+			t.Errorf("Next(%d) = %v, want 1s", attempt, got)
+		}
+	}
+}
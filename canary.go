@@ -0,0 +1,41 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+// nextCanary returns the next endpoint, routing CanaryPercent of
+// selections to the endpoints matching CanaryPredicate and the rest to the
+// other, stable, endpoints. Each pool is rotated independently. If one pool
+// is empty all selections go to the other. Only endpoints accept returns
+// true for are considered, or all if accept is nil. lb.mu must be held.
+func (lb *LoadBalancer) nextCanary(accept func(Endpoint) bool) (Endpoint, error) {
+	var canary, stable []Endpoint
+	for _, ep := range lb.candidates(accept) {
+		if lb.canaryPredicate(ep) {
+			canary = append(canary, ep)
+		} else {
+			stable = append(stable, ep)
+		}
+	}
+
+	// Spread canary selections evenly instead of in bursts by
+	// accumulating the configured percentage on every call.
+	useCanary := false
+	lb.canaryCredit += lb.canaryPercent
+	if lb.canaryCredit >= 100 {
+		lb.canaryCredit -= 100
+		useCanary = true
+	}
+
+	pool, cursor := stable, &lb.stableCursor
+	if (useCanary && len(canary) > 0) || len(stable) == 0 {
+		pool, cursor = canary, &lb.canaryCursor
+	}
+	if len(pool) == 0 {
+		return Endpoint{}, ErrNoEndpoints
+	}
+	i := *cursor % len(pool)
+	*cursor = (i + 1) % len(pool)
+	return pool[i], nil
+}
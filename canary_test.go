@@ -0,0 +1,63 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"strings"
+	"testing"
+)
+
+func isCanary(e Endpoint) bool { return strings.HasPrefix(e.Host, "10.1.") }
+
+func TestCanarySplit(t *testing.T) {
+	lb := newStatic(&Config{CanaryPredicate: isCanary, CanaryPercent: 20},
+		ep("10.0.0.1", "80"), ep("10.0.0.2", "80"), ep("10.0.0.3", "80"),
+		ep("10.1.0.1", "80"), ep("10.1.0.2", "80"))
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		got, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[got.Host]++
+	}
+	canary := counts["10.1.0.1"] + counts["10.1.0.2"]
+	if canary < 190 || canary > 210 {
+		t.Fatalf("canary endpoints received %d of 1000 selections, want about 200", canary)
+	}
+	// Each pool is rotated through evenly.
+	if d := counts["10.1.0.1"] - counts["10.1.0.2"]; d < -1 || d > 1 {
+		t.Errorf("canary selections = %d, %d, want an even split", counts["10.1.0.1"], counts["10.1.0.2"])
+	}
+	for _, host := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if n := counts[host]; n < 260 || n > 275 {
+			t.Errorf("stable endpoint %s received %d of 1000 selections, want about 267", host, n)
+		}
+	}
+}
+
+func TestCanaryEmptyPool(t *testing.T) {
+	tests := []struct {
+		name   string
+		eps    []Endpoint
+		canary bool
+	}{
+		{"no canary", []Endpoint{ep("10.0.0.1", "80"), ep("10.0.0.2", "80")}, false},
+		{"only canary", []Endpoint{ep("10.1.0.1", "80"), ep("10.1.0.2", "80")}, true},
+	}
+	for _, tt := range tests {
+		lb := newStatic(&Config{CanaryPredicate: isCanary, CanaryPercent: 50}, tt.eps...)
+		for i := 0; i < 10; i++ {
+			got, err := lb.Next()
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if isCanary(got) != tt.canary {
+				t.Fatalf("%s: Next() = %s", tt.name, got.Host)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"fmt"
+	"io"
+)
+
+// decodeSnippetSize bounds the length of DecodeError.Snippet.
+const decodeSnippetSize = 512
+
+// A DecodeError reports a Kubernetes API response that could not be
+// decoded, or did not hold the kind of object expected, such as when a
+// proxy wraps or replaces the response.
+type DecodeError struct {
+	Path string // path of the API request, or empty if not read from the API
+	Err  error  // underlying decoding error
+
+	// Snippet is up to 512 bytes of the response body: the beginning of
+	// a list response, or the data following the failure in a watch
+	// stream.
+	Snippet string
+}
+
+func (e *DecodeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("endpoints decode: %s (body: %q)", e.Err, e.Snippet)
+	}
+	return fmt.Sprintf("endpoints decode %s: %s (body: %q)", e.Path, e.Err, e.Snippet)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// decode decodes the JSON object read from r into v and checks that its
+// kind is the expected one. Malformed data and unexpected kinds are
+// reported as a *DecodeError.
+func (lb *LoadBalancer) decode(r io.Reader, path string, v interface{ kind() string }, kind string) error {
+	sr := &snippetReader{r: r}
+	err := lb.newDecoder(sr).Decode(v)
+	if err == nil && v.kind() != "" && v.kind() != kind {
+		err = fmt.Errorf("unexpected kind %q, want %q", v.kind(), kind)
+		return &DecodeError{Path: path, Err: err, Snippet: string(sr.buf)}
+	}
+	if isParseError(err) {
+		return &DecodeError{Path: path, Err: err, Snippet: string(sr.buf)}
+	}
+	return err
+}
+
+// newDecodeError returns a *DecodeError for err, taking the snippet from
+// the data buffered by the decoder of a watch stream.
+func newDecodeError(path string, buffered io.Reader, err error) *DecodeError {
+	buf := make([]byte, decodeSnippetSize)
+	n, _ := io.ReadFull(buffered, buf)
+	return &DecodeError{Path: path, Err: err, Snippet: string(buf[:n])}
+}
+
+// snippetReader records the first decodeSnippetSize bytes read through it.
+type snippetReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (s *snippetReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if room := decodeSnippetSize - len(s.buf); room > 0 {
+		if room > n {
+			room = n
+		}
+		s.buf = append(s.buf, p[:room]...)
+	}
+	return n, err
+}
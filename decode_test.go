@@ -0,0 +1,55 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDecodeErrorContext(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string // in the underlying error
+	}{
+		{"truncated", `{"kind":"Endpoints","subsets":[{"addresses":[`, "unexpected EOF"},
+		{"html", "<html><body>502 Bad Gateway</body></html>", "invalid character"},
+		{"wrapped", `{"kind":"Envelope","data":{"kind":"Endpoints"}}`, `unexpected kind "Envelope"`},
+		{"long", `{"kind":"Endpoints","junk":"` + strings.Repeat("x", 2*decodeSnippetSize), "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		api := newFakeAPI(t, endpoints{})
+		api.setList(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, tt.body)
+		})
+		err := New(api.config()).SyncEndpoints()
+
+		var e *DecodeError
+		if !errors.As(err, &e) {
+			t.Fatalf("%s: SyncEndpoints() error = %v, want a *DecodeError", tt.name, err)
+		}
+		if !strings.Contains(e.Err.Error(), tt.err) {
+			t.Errorf("%s: Err = %v, want %q", tt.name, e.Err, tt.err)
+		}
+		if e.Path != "/api/v1/namespaces/default/endpoints/test" {
+			t.Errorf("%s: Path = %q", tt.name, e.Path)
+		}
+		want := tt.body
+		if len(want) > decodeSnippetSize {
+			want = want[:decodeSnippetSize]
+		}
+		if e.Snippet != want {
+			t.Errorf("%s: Snippet = %q, want %q", tt.name, e.Snippet, want)
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("%q", want)) {
+			t.Errorf("%s: error %q does not quote the body", tt.name, err)
+		}
+	}
+}
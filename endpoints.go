@@ -6,35 +6,64 @@ package endpoints
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	endpointsPath      = "/api/v1/namespaces/%s/endpoints/%s"
 	endpointsWatchPath = "/api/v1/watch/namespaces/%s/endpoints/%s"
+	slicesPath         = "/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?labelSelector=kubernetes.io%%2Fservice-name%%3D%s"
+	slicesWatchPath    = slicesPath + "&watch=true"
 )
 
+// Update sources reported by LastUpdateSource.
 const (
-	defaultSyncInterval = 30 * time.Second
-	defaultRetryDelay   = 5 * time.Second
+	sourceReconcile = "reconcile"
+	sourceWatch     = "watch"
+)
+
+const (
+	defaultSyncInterval  = 30 * time.Second
+	defaultRetryDelay    = 5 * time.Second
+	defaultMaxRetryDelay = 2 * time.Minute
+
+	defaultDialTimeout           = 10 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
 )
 
 var (
+	DefaultAccept    = "application/json, */*"
 	DefaultAPIAddr   = "127.0.0.1:8001"
 	DefaultNamespace = "default"
 )
 
+// Service account files mounted into pods running in-cluster.
+var (
+	namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	tokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	caFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
 var (
 	// ErrNoEndpoints is returned by LoadBalancer.Next calls when a named service
 	// has no backends.
@@ -44,6 +73,30 @@ var (
 	// when attempting to synchronize endpoints with a config that contains a
 	// missing or blank service name.
 	ErrMissingServiceName = errors.New("endpoints: missing service name")
+
+	// ErrAmbiguousPort is returned by LoadBalancer.Next calls when the
+	// LoadBalancer is configured with RequireExplicitPort. Use NextForPort to
+	// select an endpoint for a named port instead.
+	ErrAmbiguousPort = errors.New("endpoints: ambiguous port, use NextForPort")
+
+	// ErrAllEndpointsBusy is returned by LoadBalancer.Next calls when every
+	// otherwise selectable endpoint holds MaxLeasesPerEndpoint leases.
+	ErrAllEndpointsBusy = errors.New("endpoints: all endpoints busy")
+
+	// ErrPortNotFound is returned, wrapped with the name of the port, by
+	// NextForPort and NextMultiPort when no endpoint serves a requested
+	// port.
+	ErrPortNotFound = errors.New("endpoints: port not found")
+
+	// ErrNotSynced is returned by LoadBalancer.Next calls before the
+	// endpoints were first synchronized with the Kubernetes API or set by
+	// Prime, to tell a LoadBalancer that is still starting apart from a
+	// service without backends.
+	ErrNotSynced = errors.New("endpoints: endpoints not synced yet")
+
+	// ErrDraining is returned by LoadBalancer.Next calls between Drain and
+	// Undrain.
+	ErrDraining = errors.New("endpoints: load balancer draining")
 )
 
 // Endpoint holds a Kubernetes endpoint.
@@ -51,17 +104,177 @@ type Endpoint struct {
 	Host  string
 	Port  string
 	Ports map[string]string
+
+	// AllPorts lists every port of the subset the endpoint was taken from,
+	// in the order of the Endpoints object, including unnamed ports. Port
+	// and Ports are derived from it.
+	AllPorts []Port
+
+	// Protocols maps port names to their application protocol, such as
+	// "http" or "grpc", for ports that declare an appProtocol.
+	Protocols map[string]string
+
+	// PortProtocols maps port names to their transport protocol, "TCP",
+	// "UDP" or "SCTP".
+	PortProtocols map[string]string
+
+	// Namespace is the namespace of the Endpoints object the endpoint was
+	// taken from, if known.
+	Namespace string
+
+	// NodeName is the node hosting the endpoint, if known.
+	NodeName string
+
+	// Hostname is the hostname of the address the endpoint was created
+	// from, if it has one.
+	Hostname string
+
+	// Zone is the topology zone of the endpoint, if known.
+	Zone string
+
+	// Weight is the relative share of selections the endpoint receives
+	// when weights differ between endpoints. It defaults to 1. Endpoints
+	// with a weight of zero or less are never selected.
+	Weight int
+
+	// MaintenanceUntil is the end of a maintenance window announced
+	// through MaintenanceAnnotation. The endpoint is not selected before
+	// then.
+	MaintenanceUntil time.Time
+
+	// Ready reports whether the address was listed as ready. Not-ready
+	// addresses are only returned when IncludeNotReady is set.
+	Ready bool
+}
+
+// PortInfo describes a port of an Endpoints subset.
+type PortInfo struct {
+	Name        string
+	Port        int
+	Protocol    string
+	AppProtocol string
+}
+
+// A Port is a port served by an endpoint.
+type Port struct {
+	// Name is empty for the single port of a service with one unnamed
+	// port.
+	Name   string
+	Number int
+
+	// Protocol is the transport protocol, "TCP", "UDP" or "SCTP".
+	Protocol string
+}
+
+// An Address is an address of the Endpoints object, as seen by
+// AddressFilter.
+type Address struct {
+	// Namespace is the namespace of the Endpoints object, if known.
+	Namespace string
+
+	// IP is empty for addresses that carry only a Hostname.
+	IP       string
+	Hostname string
+	NodeName string
+	Zone     string
+
+	// TargetKind and TargetName identify the object backing the address,
+	// usually a "Pod", if known.
+	TargetKind string
+	TargetName string
+
+	// Ready is false for not-ready addresses, which are only considered
+	// when IncludeNotReady is set.
+	Ready bool
+}
+
+// key identifies the endpoint in per-endpoint bookkeeping.
+func (e Endpoint) key() string {
+	return net.JoinHostPort(e.Host, e.Port)
+}
+
+// port returns the number of the named port if the endpoint serves it over
+// protocol, or over any protocol if protocol is empty.
+func (e Endpoint) port(name, protocol string) (string, bool) {
+	port, ok := e.Ports[name]
+	if !ok || (protocol != "" && !strings.EqualFold(e.PortProtocols[name], protocol)) {
+		return "", false
+	}
+	return port, true
+}
+
+// AppProtocol returns the application protocol of the named port, or an
+// empty string if the port does not declare one.
+func (e Endpoint) AppProtocol(portName string) string {
+	return e.Protocols[portName]
 }
 
 // A Config structure is used to configure a LoadBalancer.
 type Config struct {
+	// Accept is the Accept header sent with requests to the Kubernetes API.
+	// If empty, DefaultAccept is used. Responses are always decoded as JSON,
+	// so the API server must be able to fall back to it.
+	Accept string
+
+	// AddressFilter optionally selects the addresses of the Endpoints
+	// object that become endpoints. Addresses for which it returns false
+	// are dropped before hostnames are resolved.
+	AddressFilter func(Address) bool
+
 	// APIAddr specifies the Kubernetes API "IP:port" address to use
 	// when synchronizing enpoints. If empty, DefaultAPIAddr is used.
 	APIAddr string
 
+	// APIRequestTimeout bounds each list request to the Kubernetes API,
+	// including reading the response. It does not apply to the watch,
+	// which stays open indefinitely. If zero, list requests are only
+	// bounded by the timeouts of the Client.
+	APIRequestTimeout time.Duration
+
+	// AutoDetectNamespace enables reading the namespace of the pod the
+	// LoadBalancer runs in from its service account when Namespace is empty.
+	// If the namespace cannot be read, DefaultNamespace is used.
+	AutoDetectNamespace bool
+
+	// Backoff determines the delay between API calls after an error occurs,
+	// both when re-establishing the watch and when retrying a failed
+	// reconciliation. If nil, an ExponentialBackoff with full jitter is used,
+	// starting at RetryDelay and capped at MaxRetryDelay.
+	Backoff Backoff
+
+	// BearerToken is sent in the Authorization header of every request to
+	// the Kubernetes API. It is ignored when BearerTokenFile is set.
+	BearerToken string
+
+	// BearerTokenFile names a file holding the bearer token, such as a
+	// projected service account token. The file is read again every minute
+	// so that rotated tokens are picked up.
+	BearerTokenFile string
+
+	// CanaryPredicate identifies canary endpoints. When set together with
+	// CanaryPercent, that percentage of selections goes to canary endpoints
+	// and the remainder to the other endpoints, ignoring endpoint weights.
+	// It is called with the LoadBalancer locked and must not block.
+	CanaryPredicate func(Endpoint) bool
+
+	// CanaryPercent is the percentage, from 0 to 100, of selections routed
+	// to canary endpoints.
+	CanaryPercent int
+
+	// CapacityHeader names a response header through which backends report
+	// their remaining capacity. When set, responses received through
+	// Transport update the capacity of their endpoint, and endpoints are
+	// selected in proportion to their weight times their last reported
+	// capacity. Endpoints that have not reported a capacity count as having
+	// a capacity of 1, as do those reporting less.
+	CapacityHeader string
+
 	// The http.Client used to perform requests to the Kubernetes API.
-	// If nil, http.DefaultClient is used. Using the http.DefaultClient
-	// will require the use of kubectl running in proxy mode:
+	// If nil, a client honoring the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables, with timeouts for connecting, the TLS
+	// handshake and response headers, is used. Without authentication
+	// configured, this will require the use of kubectl running in proxy
+	// mode:
 	//
 	//    $ kubectl proxy
 	//    Starting to serve on 127.0.0.1:8001
@@ -73,40 +286,387 @@ type Config struct {
 
 	// ErrorLog specifies an optional logger for errors that occur when
 	// attempting to sync endpoints. If nil, logging goes to os.Stderr via
-	// the log package's standard logger.
+	// the log package's standard logger. It is not used when Logger is set.
 	ErrorLog *log.Logger
 
+	// FailOpen makes selection fall back to the endpoint with the lowest
+	// error rate, then the fewest consecutive failures, when every endpoint
+	// is excluded by health checks, MinStableDuration or canary routing,
+	// instead of returning ErrNoEndpoints.
+	FailOpen bool
+
+	// HealthCheck optionally enables active health checking of endpoints
+	// while background synchronization is running.
+	HealthCheck *HealthCheck
+
+	// IncludeNotReady also turns the not-ready addresses of the Endpoints
+	// object into endpoints, with Ready unset, so they are selected
+	// alongside ready ones. By default only ready addresses are used.
+	IncludeNotReady bool
+
+	// LocalZone is the topology zone of the caller. When set, endpoints
+	// whose Zone matches it are selected exclusively as long as any of them
+	// is selectable. Once none is, selection falls back to endpoints in all
+	// zones.
+	LocalZone string
+
+	// Logger optionally receives errors that occur when attempting to sync
+	// endpoints as structured records, with the namespace and service and,
+	// for failed API calls, the URL and status code as attributes. When set,
+	// ErrorLog is not used.
+	Logger *slog.Logger
+
+	// MaintenanceAnnotation optionally names an annotation on the Endpoints
+	// object announcing maintenance windows as comma-separated
+	// "<pod IP or pod name>=<RFC 3339 time>" entries. Listed endpoints are
+	// not selected until the given time, but are still returned by
+	// Endpoints with MaintenanceUntil set. Malformed entries are ignored.
+	MaintenanceAnnotation string
+
+	// MaxEndpoints, if positive, caps the number of endpoints tracked. When
+	// an update holds more, a sample of MaxEndpoints endpoints is kept: the
+	// ones whose Host and Port hash lowest, so that the same endpoints are
+	// kept from one sync to the next and only endpoints joining or leaving
+	// change the sample. The number of endpoints left out is reported by
+	// Stats.
+	MaxEndpoints int
+
+	// MaxLeasesPerEndpoint limits the number of requests the RoundTripper
+	// returned by Transport sends to an endpoint concurrently. A lease is
+	// held from dispatch until the response body is closed, and endpoints
+	// holding the maximum are skipped by selection. If zero, there is no
+	// limit.
+	MaxLeasesPerEndpoint int
+
+	// MaxRetryDelay caps the delay between API calls after errors. If
+	// empty, two minutes is used. MaxRetryDelay is ignored when Backoff is
+	// set.
+	MaxRetryDelay time.Duration
+
+	// MaxWatchReconnects is the number of consecutive failed attempts to
+	// establish the endpoints watch after which the watch is abandoned,
+	// leaving the reconciliation loop as the only sync mechanism. If zero,
+	// the watch is retried forever.
+	MaxWatchReconnects int
+
+	// MinEndpoints is the number of selectable endpoints the primary tier
+	// must have before Next stops spilling over into backup tiers added
+	// with AddTier. If zero, 1 is used.
+	MinEndpoints int
+
+	// MinStableDuration is the amount of time an endpoint must be
+	// continuously present before Next selects it, giving new pods time to
+	// settle. Endpoints are listed by Endpoints immediately. Endpoints
+	// present when the LoadBalancer first syncs are considered stable.
+	MinStableDuration time.Duration
+
 	// The Kubernetes namespace to search for services.
-	// If empty, DefaultNamespace is used.
+	// If empty, DefaultNamespace is used unless AutoDetectNamespace is set.
 	Namespace string
 
-	// RetryDelay is the amount of time to wait between API calls after an error
-	// occurs. If empty, DefaultRetryDelay is used.
+	// Namespaces optionally watches the service in several namespaces
+	// instead of Namespace, using a single cluster-wide watch. Objects in
+	// other namespaces are ignored, unless Namespaces holds AllNamespaces.
+	// The endpoints of all namespaces are combined, each tagged with its
+	// Namespace. ReadinessAnnotation and MaintenanceAnnotation do not apply.
+	Namespaces []string
+
+	// NodeZone optionally maps a node name to its topology zone and is used
+	// to populate Endpoint.Zone, which the v1 Endpoints API does not report.
+	NodeZone func(nodeName string) string
+
+	// OnChange is called with the previous and the new endpoints whenever
+	// an update changes the set of endpoints or their attributes. Updates
+	// that produce an identical set do not call it. It is called without
+	// the LoadBalancer locked, from the goroutine applying the update.
+	// AddListener registers further functions.
+	OnChange func(old, new []Endpoint)
+
+	// OnPortChange is called when an endpoint keeps its address but its
+	// ports change, such as after a rollout remaps container ports. It is
+	// called once per changed address, with its first updated endpoint and
+	// the old and new named ports of all endpoints sharing the address.
+	OnPortChange func(ep Endpoint, oldPorts, newPorts map[string]string)
+
+	// OnRequest is called with the method and fully resolved URL of every
+	// Kubernetes API request just before it is sent. Request headers, which
+	// may carry credentials, are not reported.
+	OnRequest func(method, url string)
+
+	// OnServiceDeleted is called when the Endpoints object of the service
+	// is found deleted after it existed, either through a watch event or a
+	// list request. The endpoints are then cleared, so OnChange is called
+	// with an empty set. If the service is created again, its endpoints are
+	// picked up as usual.
+	OnServiceDeleted func()
+
+	// OnSyncComplete is called after every list request with the HTTP
+	// status code of the response, or zero if none was received, the time
+	// taken to fetch and decode the response, and the resulting error.
+	OnSyncComplete func(statusCode int, duration time.Duration, err error)
+
+	// OnWatchGaveUp is called with the last error when the watch is
+	// abandoned after MaxWatchReconnects failed attempts, or when
+	// RetryPolicy gives up. To stop the LoadBalancer entirely, call Shutdown
+	// from a new goroutine.
+	OnWatchGaveUp func(error)
+
+	// OnWatchReconnected is called every time the endpoints watch is
+	// re-established after the previous watch ended.
+	OnWatchReconnected func()
+
+	// OnWatchSynced is called once per watch connection, after the first
+	// event received on it has been applied. When the watch does not resume
+	// from the resource version of an earlier list or event, that event
+	// holds the complete current state of the endpoints.
+	OnWatchSynced func()
+
+	// ParseCapacity parses values of CapacityHeader. Values it rejects are
+	// ignored. If nil, strconv.Atoi is used.
+	ParseCapacity func(string) (int, error)
+
+	// PreferredPortOrder lists port names in priority order. The default
+	// Port of each Endpoint is the first listed port the endpoint serves,
+	// or its first port if none of the names match.
+	PreferredPortOrder []string
+
+	// ReadinessAnnotation optionally names an annotation on the Endpoints
+	// object listing, as comma-separated pod IPs or pod names, the addresses
+	// that have passed a custom readiness gate. When set, only the listed
+	// addresses are used, layering the custom gate atop Kubernetes readiness.
+	ReadinessAnnotation string
+
+	// RequestTimeout bounds each attempt made by the RoundTripper returned
+	// by Transport, independently of the request context. If zero, attempts
+	// are bounded only by the request context.
+	RequestTimeout time.Duration
+
+	// RequireExplicitPort leaves the default Port of every Endpoint empty
+	// and makes Next return ErrAmbiguousPort, forcing callers to pick a
+	// named port with NextForPort. Use it for services whose ports are all
+	// named and have no sensible default.
+	RequireExplicitPort bool
+
+	// Resolver resolves addresses that carry a hostname but no IP into one
+	// endpoint per resolved IP. Lookups run in the background and are
+	// cached. If nil, net.DefaultResolver is used.
+	Resolver Resolver
+
+	// RetryableError reports whether a failed Kubernetes API call should be
+	// retried after the Backoff delay. statusCode is the status code of the
+	// error, or zero if the call failed without one. Errors that are not
+	// retryable are tried again only after SyncInterval. If nil, connection
+	// and decoding errors, 429 and 5xx responses are retryable.
+	RetryableError func(err error, statusCode int) bool
+
+	// RetryDelay is the base delay between API calls after an error occurs,
+	// doubled after every further failure. If empty, DefaultRetryDelay is
+	// used. RetryDelay is ignored when Backoff is set.
 	RetryDelay time.Duration
 
+	// RetryNextOnError makes the RoundTripper returned by Transport retry a
+	// failed or timed out attempt against the next endpoint, up to three
+	// attempts per request.
+	RetryNextOnError bool
+
+	// RetryPolicy decides whether to retry a failed Kubernetes API call and
+	// how long to wait first. attempt counts the consecutive failures from
+	// 1, and err is a *SyncError when the API server responded with an
+	// error status. It is consulted by SyncEndpoints, which otherwise makes
+	// a single attempt, and by the watch loop, where it replaces Backoff,
+	// RetryableError and MaxWatchReconnects: the watch is abandoned when
+	// RetryPolicy returns false. Reconciliation waits SyncInterval after a
+	// sync RetryPolicy gave up on.
+	RetryPolicy func(attempt int, err error) (retry bool, delay time.Duration)
+
+	// Scheme is the URL scheme used to reach the Kubernetes API, "http" or
+	// "https". If empty, "https" is used when TLSClientConfig is set and
+	// "http" otherwise.
+	Scheme string
+
 	// The Kubernetes service to monitor.
 	Service string
 
+	// Strategy selects among the selectable endpoints, replacing the
+	// built-in selection. Canary routing still takes precedence. If nil,
+	// endpoints are selected in round-robin order, honoring endpoint
+	// weights and reported capacity.
+	Strategy Strategy
+
+	// StrictJSON rejects API responses containing fields unknown to the
+	// package instead of ignoring them, surfacing schema drift between
+	// Kubernetes versions as sync errors.
+	StrictJSON bool
+
+	// SubsetSelector chooses the subsets of the Endpoints object endpoints
+	// are taken from. It is called with the index and ports of each subset
+	// and only the subsets it accepts are used. If nil, every subset is
+	// used.
+	SubsetSelector func(subsetIndex int, ports []PortInfo) bool
+
 	// SyncInterval is the amount of time between request to reconcile the list
 	// of endpoint backends from Kubernetes.
 	SyncInterval time.Duration
+
+	// SyncJitter spreads reconciliations of LoadBalancers started together
+	// by randomizing each interval between SyncInterval × (1 - SyncJitter)
+	// and SyncInterval × (1 + SyncJitter). It is clamped to [0, 1]. If zero,
+	// every interval is exactly SyncInterval.
+	SyncJitter float64
+
+	// TLSClientConfig configures TLS for requests to the Kubernetes API.
+	// When set and Client is nil, a client using it is created, and Scheme
+	// defaults to "https".
+	TLSClientConfig *tls.Config
+
+	// UseEndpointSlices makes the LoadBalancer read the EndpointSlices of
+	// the service from the discovery.k8s.io/v1 API instead of its Endpoints
+	// object. The addresses of all slices are combined, and only those with
+	// a ready condition that is true or unset are used. The zone of each
+	// address is taken from its slice, falling back to NodeZone.
+	// ReadinessAnnotation and MaintenanceAnnotation do not apply, as
+	// EndpointSlices do not carry the annotations of the Endpoints object.
+	UseEndpointSlices bool
+
+	// WatchTimeout asks the API server to end each watch after the given
+	// duration, rounded to whole seconds, upon which the watch is
+	// re-established from the last seen resource version. Watches ended
+	// this way, or closed cleanly by the API server for any other reason,
+	// are not logged. If zero, the timeout of the API server applies.
+	WatchTimeout time.Duration
+
+	// WeightFunc returns the weight of an endpoint, which is multiplied into
+	// the weight computed by ZoneBalance. Endpoints given a weight of zero
+	// are never selected. If nil, weights are left as computed by
+	// ZoneBalance.
+	WeightFunc func(Endpoint) int
+
+	// ZoneBalance computes endpoint weights from the number of endpoints in
+	// each zone. Zones are taken from Endpoint.Zone.
+	ZoneBalance ZoneBalance
+}
+
+// A Balancer hands out endpoints. It is implemented by *LoadBalancer,
+// including the ones returned by NewStatic, so code that depends on a
+// Balancer can be tested without Kubernetes.
+type Balancer interface {
+	// Next returns the next endpoint.
+	Next() (Endpoint, error)
+
+	// Endpoints returns the current set of endpoints.
+	Endpoints() []Endpoint
 }
 
 // LoadBalancer represents a Kubernetes endpoints round-robin load balancer.
 type LoadBalancer struct {
-	apiAddr      string
-	client       *http.Client
-	errorLog     *log.Logger
-	namespace    string
-	retryDelay   time.Duration
-	service      string
-	syncInterval time.Duration
-	quit         chan struct{}
-	wg           sync.WaitGroup
-
-	mu              sync.RWMutex // protects currentEndpoint and endpoints
-	currentEndpoint int
-	endpoints       []Endpoint
+	accept              string
+	addressFilter       func(Address) bool
+	apiAddr             string
+	apiRequestTimeout   time.Duration
+	backoff             Backoff
+	bearerToken         string
+	bearerTokenFile     string
+	canaryPercent       int
+	canaryPredicate     func(Endpoint) bool
+	capacityHeader      string
+	client              *http.Client
+	errorLog            *log.Logger
+	failOpen            bool
+	healthCheck         *HealthCheck
+	includeNotReady     bool
+	localZone           string
+	logger              *slog.Logger
+	maintenanceKey      string
+	maxEndpoints        int
+	maxLeases           int
+	maxWatchReconnects  int
+	minEndpoints        int
+	minStableDuration   time.Duration
+	namespace           string
+	namespaces          map[string]bool
+	nodeZone            func(string) string
+	onChange            func([]Endpoint, []Endpoint)
+	onPortChange        func(Endpoint, map[string]string, map[string]string)
+	onRequest           func(string, string)
+	onServiceDeleted    func()
+	onSyncComplete      func(int, time.Duration, error)
+	onWatchGaveUp       func(error)
+	onWatchReconnected  func()
+	onWatchSynced       func()
+	parseCapacity       func(string) (int, error)
+	preferredPortOrder  []string
+	readinessAnnotation string
+	requestTimeout      time.Duration
+	requireExplicitPort bool
+	resolver            Resolver
+	retryableError      func(error, int) bool
+	retryNextOnError    bool
+	retryPolicy         func(int, error) (bool, time.Duration)
+	scheme              string
+	service             string
+	strategy            Strategy
+	strictJSON          bool
+	subsetSelector      func(int, []PortInfo) bool
+	syncInterval        time.Duration
+	syncJitter          float64
+	useEndpointSlices   bool
+	watchTimeout        time.Duration
+	weightFunc          func(Endpoint) int
+	zoneBalance         ZoneBalance
+	now                 func() time.Time // the clock, replaced by tests
+	quit                chan struct{}
+	shutdown            sync.Once
+	wg                  sync.WaitGroup
+
+	resolverCache resolverCache
+	tokenCache    tokenCache
+
+	slicesMu sync.Mutex
+	slices   map[string]endpointSlice // current EndpointSlices by namespace and name
+
+	byNamespace map[string]endpoints // current Endpoints objects when watching several namespaces
+
+	applyMu          sync.Mutex // serializes apply and protects lastObject
+	lastObject       *endpoints
+	lastObjectSource string
+	formatted        []formattedVersion
+
+	goroutines    int64  // accessed atomically
+	droppedEvents uint64 // accessed atomically
+	eventsMu      sync.Mutex
+	events        chan Event
+	eventsClosed  bool
+
+	subscribersMu     sync.Mutex // protects the fields below
+	subscribers       map[*subscriber]bool
+	subscribersClosed bool
+	listeners         []func(old, new []Endpoint)
+
+	mu               sync.RWMutex // protects the fields below
+	currentEndpoint  int
+	endpoints        []Endpoint
+	updated          chan struct{} // closed and replaced on every update
+	lastUpdateSource string
+	lastUpdateAt     time.Time
+	synced           bool                 // endpoints were set by a sync or Prime
+	draining         bool                 // between Drain and Undrain
+	serviceExists    bool                 // the last list request found the Endpoints object
+	resourceVersion  string               // of the latest object listed or watched
+	lastProbe        time.Time            // end of the last health probe round
+	leases           map[string]int       // outstanding leases by endpoint key
+	unhealthy        map[string]bool      // endpoint keys that failed their last probe
+	firstSeen        map[string]time.Time // when each endpoint key appeared
+	localOnly        bool                 // only endpoints in localZone are selectable
+	weighted         bool                 // endpoints have differing weights
+	currentWeights   map[string]int       // smooth weighted round-robin state
+	stats            Stats
+	endpointStats    map[string]*EndpointStats
+	tiers            []tier // backup tiers in ascending priority order
+	tierCursor       int
+	canaryCredit     int
+	canaryCursor     int
+	stableCursor     int
+	portCursors      map[string]int // per-port round-robin state of NextForPort
 }
 
 // New configures and returns a new *LoadBalancer. The LoadBalancer endpoints
@@ -114,19 +674,74 @@ type LoadBalancer struct {
 func New(config *Config) *LoadBalancer {
 	config.setDefaults()
 
-	return &LoadBalancer{
-		apiAddr:      config.APIAddr,
-		client:       config.Client,
-		errorLog:     config.ErrorLog,
-		namespace:    config.Namespace,
-		retryDelay:   config.RetryDelay,
-		service:      config.Service,
-		syncInterval: config.SyncInterval,
-		quit:         make(chan struct{}),
+	lb := &LoadBalancer{
+		accept:              config.Accept,
+		addressFilter:       config.AddressFilter,
+		apiAddr:             config.APIAddr,
+		apiRequestTimeout:   config.APIRequestTimeout,
+		backoff:             config.Backoff,
+		bearerToken:         config.BearerToken,
+		bearerTokenFile:     config.BearerTokenFile,
+		canaryPercent:       config.CanaryPercent,
+		canaryPredicate:     config.CanaryPredicate,
+		capacityHeader:      config.CapacityHeader,
+		client:              config.Client,
+		errorLog:            config.ErrorLog,
+		failOpen:            config.FailOpen,
+		healthCheck:         config.HealthCheck,
+		includeNotReady:     config.IncludeNotReady,
+		localZone:           config.LocalZone,
+		logger:              config.Logger,
+		maintenanceKey:      config.MaintenanceAnnotation,
+		maxEndpoints:        config.MaxEndpoints,
+		maxLeases:           config.MaxLeasesPerEndpoint,
+		maxWatchReconnects:  config.MaxWatchReconnects,
+		minEndpoints:        config.MinEndpoints,
+		minStableDuration:   config.MinStableDuration,
+		namespace:           config.Namespace,
+		namespaces:          namespaceSet(config.Namespaces),
+		nodeZone:            config.NodeZone,
+		onChange:            config.OnChange,
+		onPortChange:        config.OnPortChange,
+		onRequest:           config.OnRequest,
+		onServiceDeleted:    config.OnServiceDeleted,
+		onSyncComplete:      config.OnSyncComplete,
+		onWatchGaveUp:       config.OnWatchGaveUp,
+		onWatchReconnected:  config.OnWatchReconnected,
+		onWatchSynced:       config.OnWatchSynced,
+		parseCapacity:       config.ParseCapacity,
+		preferredPortOrder:  config.PreferredPortOrder,
+		readinessAnnotation: config.ReadinessAnnotation,
+		requestTimeout:      config.RequestTimeout,
+		requireExplicitPort: config.RequireExplicitPort,
+		resolver:            config.Resolver,
+		retryableError:      config.RetryableError,
+		retryNextOnError:    config.RetryNextOnError,
+		retryPolicy:         config.RetryPolicy,
+		scheme:              config.Scheme,
+		service:             config.Service,
+		strategy:            config.Strategy,
+		strictJSON:          config.StrictJSON,
+		subsetSelector:      config.SubsetSelector,
+		syncInterval:        config.SyncInterval,
+		syncJitter:          config.SyncJitter,
+		useEndpointSlices:   config.UseEndpointSlices,
+		watchTimeout:        config.WatchTimeout,
+		weightFunc:          config.WeightFunc,
+		zoneBalance:         config.ZoneBalance,
+		now:                 time.Now,
+		quit:                make(chan struct{}),
+		updated:             make(chan struct{}),
+		events:              make(chan Event, eventBufferSize),
+	}
+	if s, ok := config.Strategy.(*StrategyAdaptiveWeight); ok {
+		s.setClock(func() time.Time { return lb.now() })
 	}
+	return lb
 }
 
-// Endpoints returns a copy of the current set of endpoints.
+// Endpoints returns a copy of the current set of endpoints, sorted by host
+// and then port.
 func (lb *LoadBalancer) Endpoints() []Endpoint {
 	lb.mu.RLock()
 	eps := make([]Endpoint, len(lb.endpoints))
@@ -137,34 +752,413 @@ func (lb *LoadBalancer) Endpoints() []Endpoint {
 
 // Next returns the next Kubernetes endpoint.
 func (lb *LoadBalancer) Next() (Endpoint, error) {
+	if lb.requireExplicitPort {
+		return Endpoint{}, ErrAmbiguousPort
+	}
+	lb.mu.Lock()
+	if len(lb.tiers) > 0 {
+		lb.mu.Unlock()
+		return lb.nextTiered()
+	}
+	defer lb.mu.Unlock()
+	return lb.selected(lb.next())
+}
+
+// LastUpdateSource reports whether the current set of endpoints came from
+// a list request ("reconcile") or a watch event ("watch"), and when it was
+// applied. It returns an empty source if the endpoints were never updated.
+func (lb *LoadBalancer) LastUpdateSource() (source string, at time.Time) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.lastUpdateSource, lb.lastUpdateAt
+}
+
+// ServiceExists reports whether the Endpoints object of the service was
+// found by the last list request or watch event, even if it has no
+// endpoints. It returns false before the first successful list request and
+// after the API reports that the service does not exist.
+func (lb *LoadBalancer) ServiceExists() bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.serviceExists
+}
+
+// NextContext returns the next Kubernetes endpoint like Next, but blocks
+// while there is none, or the endpoints are not synced yet, until an update
+// provides one or ctx is done. All callers waiting on an empty LoadBalancer
+// share a single notification and are released together by the next
+// update. If ctx is done first, ctx.Err() is returned. Next itself never
+// blocks.
+func (lb *LoadBalancer) NextContext(ctx context.Context) (Endpoint, error) {
+	for {
+		// The notification is taken before selecting so that an update
+		// landing in between is not missed.
+		lb.mu.RLock()
+		updated := lb.updated
+		lb.mu.RUnlock()
+
+		endpoint, err := lb.Next()
+		if err != ErrNoEndpoints && err != ErrNotSynced {
+			return endpoint, err
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return Endpoint{}, ctx.Err()
+		}
+	}
+}
+
+// WaitForEndpoints blocks until there is at least one endpoint or ctx is
+// done, in which case ctx.Err() is returned. Like NextContext, it is woken
+// by updates rather than polling.
+func (lb *LoadBalancer) WaitForEndpoints(ctx context.Context) error {
+	for {
+		lb.mu.RLock()
+		updated := lb.updated
+		n := len(lb.endpoints)
+		lb.mu.RUnlock()
+		if n > 0 {
+			return nil
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// NextExcept returns the next Kubernetes endpoint that is not one of the
+// avoid endpoints, such as an endpoint a request just failed against.
+// ErrNoEndpoints is returned if every endpoint is excluded.
+func (lb *LoadBalancer) NextExcept(avoid ...Endpoint) (Endpoint, error) {
+	if lb.requireExplicitPort {
+		return Endpoint{}, ErrAmbiguousPort
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if err := lb.unavailable(); err != nil {
+		return Endpoint{}, err
+	}
+	return lb.selected(lb.nextWhere(func(ep Endpoint) bool {
+		return !containsEndpoint(avoid, ep)
+	}))
+}
+
+// NextForPort returns the next Kubernetes endpoint that serves the named
+// port, with Port set to that port. With plain round-robin selection each
+// port name is rotated through independently. If no endpoint serves the
+// port, an error wrapping ErrPortNotFound is returned.
+func (lb *LoadBalancer) NextForPort(name string) (Endpoint, error) {
+	return lb.NextForPortProtocol(name, "")
+}
+
+// NextForPortProtocol returns the next Kubernetes endpoint like NextForPort,
+// but only considers endpoints whose named port uses the given transport
+// protocol, such as "UDP". Protocols are compared case-insensitively.
+func (lb *LoadBalancer) NextForPortProtocol(name, protocol string) (Endpoint, error) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
-	if len(lb.endpoints) <= 0 {
-		return Endpoint{}, ErrNoEndpoints
+	if err := lb.unavailable(); err != nil {
+		return Endpoint{}, err
+	}
+	if !servesPort(lb.endpoints, name, protocol) {
+		if protocol != "" {
+			name += "/" + protocol
+		}
+		return Endpoint{}, fmt.Errorf("%w: %s", ErrPortNotFound, name)
+	}
+	if lb.roundRobin() {
+		return lb.nextForPort(name, protocol)
 	}
-	if lb.currentEndpoint >= len(lb.endpoints) {
-		lb.currentEndpoint = 0
+	endpoint, err := lb.nextWhere(func(ep Endpoint) bool {
+		_, ok := ep.port(name, protocol)
+		return ok
+	})
+	if err != nil {
+		return Endpoint{}, err
 	}
-	endpoint := lb.endpoints[lb.currentEndpoint]
-	lb.currentEndpoint++
+	lb.selected(endpoint, nil)
+	endpoint.Port, _ = endpoint.port(name, protocol)
 	return endpoint, nil
 }
 
+// Cursor returns the index in Endpoints of the endpoint round-robin
+// selection considers next. It returns 0 if there are no endpoints.
+func (lb *LoadBalancer) Cursor() int {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	if len(lb.endpoints) == 0 {
+		return 0
+	}
+	return lb.currentEndpoint % len(lb.endpoints)
+}
+
+// SetCursor sets the index in Endpoints of the endpoint round-robin
+// selection considers next. i is taken modulo the number of endpoints.
+// Weighted and canary selection keep their own state and ignore the cursor.
+func (lb *LoadBalancer) SetCursor(i int) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if n := len(lb.endpoints); n > 0 {
+		i %= n
+		if i < 0 {
+			i += n
+		}
+		lb.currentEndpoint = i
+	}
+}
+
+// NextMultiPort returns the next Kubernetes endpoint that serves every one
+// of the named ports, together with the port number of each name. If no
+// endpoint serves one of the ports, an error wrapping ErrPortNotFound and
+// naming the port is returned.
+func (lb *LoadBalancer) NextMultiPort(names ...string) (Endpoint, map[string]string, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if err := lb.unavailable(); err != nil {
+		return Endpoint{}, nil, err
+	}
+	for _, name := range names {
+		if !servesPort(lb.endpoints, name, "") {
+			return Endpoint{}, nil, fmt.Errorf("%w: %s", ErrPortNotFound, name)
+		}
+	}
+	endpoint, err := lb.nextWhere(func(ep Endpoint) bool {
+		for _, name := range names {
+			if _, ok := ep.Ports[name]; !ok {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return Endpoint{}, nil, err
+	}
+	ports := make(map[string]string, len(names))
+	for _, name := range names {
+		ports[name] = endpoint.Ports[name]
+	}
+	lb.selected(endpoint, nil)
+	return endpoint, ports, nil
+}
+
+// nextForPort returns the next selectable endpoint serving the named port
+// over protocol using a round-robin cursor kept for that port. lb.mu must be
+// held.
+func (lb *LoadBalancer) nextForPort(name, protocol string) (Endpoint, error) {
+	lb.updateLocality()
+	if lb.portCursors == nil {
+		lb.portCursors = make(map[string]int)
+	}
+	key := name + "/" + strings.ToUpper(protocol)
+	for i := 0; i < len(lb.endpoints); i++ {
+		cursor := lb.portCursors[key] % len(lb.endpoints)
+		lb.portCursors[key] = (cursor + 1) % len(lb.endpoints)
+		endpoint := lb.endpoints[cursor]
+		port, ok := endpoint.port(name, protocol)
+		if ok && lb.selectable(endpoint) {
+			lb.selected(endpoint, nil)
+			endpoint.Port = port
+			return endpoint, nil
+		}
+	}
+	return Endpoint{}, ErrNoEndpoints
+}
+
+// roundRobin reports whether endpoints are selected by plain round-robin
+// rather than by canary routing, a Strategy or weights. lb.mu must be held.
+func (lb *LoadBalancer) roundRobin() bool {
+	canary := lb.canaryPredicate != nil && lb.canaryPercent > 0
+	return !canary && lb.strategy == nil && !lb.weighted && lb.capacityHeader == ""
+}
+
+func servesPort(endpoints []Endpoint, name, protocol string) bool {
+	for _, ep := range endpoints {
+		if _, ok := ep.port(name, protocol); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// unavailable returns the error selection fails with regardless of the
+// current endpoints, or nil. lb.mu must be held.
+func (lb *LoadBalancer) unavailable() error {
+	switch {
+	case lb.draining:
+		return ErrDraining
+	case !lb.synced:
+		return ErrNotSynced
+	}
+	return nil
+}
+
+// next returns the next endpoint in rotation, failing open if configured.
+// lb.mu must be held.
+func (lb *LoadBalancer) next() (Endpoint, error) {
+	return lb.nextWhere(nil)
+}
+
+// nextWhere returns the next endpoint in rotation among those accept
+// returns true for, or among all endpoints if accept is nil, failing open
+// if configured. The endpoints accept rejects are left out before the
+// active selection runs, so they do not take turns away from the others.
+// lb.mu must be held.
+func (lb *LoadBalancer) nextWhere(accept func(Endpoint) bool) (Endpoint, error) {
+	if err := lb.unavailable(); err != nil {
+		return Endpoint{}, err
+	}
+	lb.updateLocality()
+	endpoint, err := lb.nextSelectable(accept)
+	if err == ErrNoEndpoints && len(lb.endpoints) > 0 {
+		if lb.failOpen {
+			if endpoint, ok := lb.leastBad(accept); ok {
+				return endpoint, nil
+			}
+		}
+		if lb.anySaturated() {
+			return Endpoint{}, ErrAllEndpointsBusy
+		}
+	}
+	return endpoint, err
+}
+
+// nextSelectable returns the next selectable endpoint in rotation among
+// those accept returns true for. lb.mu must be held.
+func (lb *LoadBalancer) nextSelectable(accept func(Endpoint) bool) (Endpoint, error) {
+	if lb.canaryPredicate != nil && lb.canaryPercent > 0 {
+		return lb.nextCanary(accept)
+	}
+	if lb.strategy != nil {
+		endpoints := lb.candidates(accept)
+		if len(endpoints) == 0 {
+			return Endpoint{}, ErrNoEndpoints
+		}
+		return lb.strategy.Pick(endpoints)
+	}
+	if lb.weighted || lb.capacityHeader != "" {
+		return lb.nextWeighted(accept)
+	}
+	// The cursor stays below the number of endpoints, and is reduced
+	// modulo that number first in case the endpoints shrank since the
+	// last selection.
+	n := len(lb.endpoints)
+	for i := 0; i < n; i++ {
+		cursor := lb.currentEndpoint % n
+		lb.currentEndpoint = (cursor + 1) % n
+		endpoint := lb.endpoints[cursor]
+		if lb.eligible(endpoint, accept) {
+			return endpoint, nil
+		}
+	}
+	return Endpoint{}, ErrNoEndpoints
+}
+
+// eligible reports whether endpoint is selectable and accepted by accept,
+// which may be nil to accept every endpoint. lb.mu must be held.
+func (lb *LoadBalancer) eligible(endpoint Endpoint, accept func(Endpoint) bool) bool {
+	return (accept == nil || accept(endpoint)) && lb.selectable(endpoint)
+}
+
+func containsEndpoint(endpoints []Endpoint, endpoint Endpoint) bool {
+	for _, ep := range endpoints {
+		if ep.Host == endpoint.Host && ep.Port == endpoint.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// selectable reports whether endpoint may be returned by Next. lb.mu must
+// be held.
+func (lb *LoadBalancer) selectable(endpoint Endpoint) bool {
+	return lb.excludedBecause(endpoint) == ""
+}
+
+// excludedBecause returns why endpoint may not be returned by Next, or ""
+// if it may. lb.mu must be held.
+func (lb *LoadBalancer) excludedBecause(endpoint Endpoint) string {
+	key := endpoint.key()
+	switch {
+	case lb.unhealthy[key]:
+		return "unhealthy"
+	case endpoint.Weight <= 0:
+		return "zero weight"
+	case lb.now().Before(endpoint.MaintenanceUntil):
+		return "maintenance"
+	case lb.minStableDuration > 0 && lb.now().Sub(lb.firstSeen[key]) < lb.minStableDuration:
+		return "settling"
+	case lb.saturated(key):
+		return "busy"
+	case lb.localOnly && endpoint.Zone != lb.localZone:
+		return "remote zone"
+	}
+	return ""
+}
+
+// ResetState clears the state accumulated while selecting endpoints, such
+// as the round-robin position and per-endpoint telemetry, without changing
+// the current set of endpoints.
+func (lb *LoadBalancer) ResetState() {
+	lb.mu.Lock()
+	lb.currentEndpoint = 0
+	lb.currentWeights = nil
+	lb.tierCursor = 0
+	lb.canaryCredit = 0
+	lb.canaryCursor = 0
+	lb.stableCursor = 0
+	lb.portCursors = nil
+	lb.endpointStats = nil
+	lb.mu.Unlock()
+}
+
+// Drain stops handing out endpoints: until Undrain is called, Next and the
+// other selection methods return ErrDraining. Unlike Shutdown, the
+// endpoints are still kept in sync, and requests already in flight are not
+// affected.
+func (lb *LoadBalancer) Drain() {
+	lb.mu.Lock()
+	lb.draining = true
+	lb.mu.Unlock()
+}
+
+// Undrain resumes handing out endpoints after Drain.
+func (lb *LoadBalancer) Undrain() {
+	lb.mu.Lock()
+	lb.draining = false
+	lb.mu.Unlock()
+}
+
 // Shutdown shuts down the loadbalancer. Shutdown works by stopping
 // any watches and reconciliation loops against the Kubernetes API
-// server.
+// server. Calls after the first do nothing and return nil.
 func (lb *LoadBalancer) Shutdown() error {
-	close(lb.quit)
-	lb.wg.Wait()
+	lb.shutdown.Do(func() {
+		close(lb.quit)
+		lb.wg.Wait()
+		lb.setRunning(false)
+		lb.closeEvents()
+		lb.closeSubscribers()
+	})
 	return nil
 }
 
 // SyncEndpoints syncs the endpoints for the configured Kubernetes service.
 func (lb *LoadBalancer) SyncEndpoints() error {
+	return lb.SyncEndpointsContext(context.Background())
+}
+
+// SyncEndpointsContext syncs the endpoints for the configured Kubernetes
+// service like SyncEndpoints, giving up when ctx is done.
+func (lb *LoadBalancer) SyncEndpointsContext(ctx context.Context) error {
 	if lb.service == "" {
 		return ErrMissingServiceName
 	}
-	return lb.syncEndpoints()
+	return lb.syncEndpoints(ctx)
 }
 
 // StartBackgroundSync starts a watch loop that synchronizes the list of
@@ -175,26 +1169,66 @@ func (lb *LoadBalancer) StartBackgroundSync() error {
 	}
 
 	// Start watch loop.
-	lb.wg.Add(1)
-	go lb.watchEndpoints()
+	lb.goTracked(&lb.wg, lb.watchEndpoints)
 
 	// Start reconciliation loop.
-	lb.wg.Add(1)
-	go lb.reconcile()
+	lb.goTracked(&lb.wg, lb.reconcile)
 
+	if lb.healthCheck != nil {
+		lb.goTracked(&lb.wg, lb.healthCheckLoop)
+	}
+
+	lb.setRunning(true)
 	return nil
 }
 
+// ActiveGoroutines returns the number of background goroutines started by
+// the LoadBalancer that are still running. It drops to zero once Shutdown
+// returns and any in-flight hostname lookups finish.
+func (lb *LoadBalancer) ActiveGoroutines() int {
+	return int(atomic.LoadInt64(&lb.goroutines))
+}
+
+// goTracked runs f in a new goroutine counted by ActiveGoroutines and, if
+// wg is not nil, by wg.
+func (lb *LoadBalancer) goTracked(wg *sync.WaitGroup, f func()) {
+	if wg != nil {
+		wg.Add(1)
+	}
+	atomic.AddInt64(&lb.goroutines, 1)
+	go func() {
+		defer func() {
+			atomic.AddInt64(&lb.goroutines, -1)
+			if wg != nil {
+				wg.Done()
+			}
+		}()
+		f()
+	}()
+}
+
 func (c *Config) setDefaults() {
+	if c.Scheme == "" {
+		c.Scheme = "http"
+		if c.TLSClientConfig != nil {
+			c.Scheme = "https"
+		}
+	}
+	if c.Accept == "" {
+		c.Accept = DefaultAccept
+	}
 	if c.APIAddr == "" {
 		c.APIAddr = DefaultAPIAddr
 	}
 	if c.Client == nil {
-		c.Client = http.DefaultClient
+		c.Client = newDefaultClient(c.TLSClientConfig)
 	}
 	if c.ErrorLog == nil {
 		c.ErrorLog = log.New(os.Stderr, "", log.LstdFlags)
 	}
+	if c.Namespace == "" && c.AutoDetectNamespace {
+		c.Namespace = detectNamespace()
+	}
 	if c.Namespace == "" {
 		c.Namespace = DefaultNamespace
 	}
@@ -204,99 +1238,746 @@ func (c *Config) setDefaults() {
 	if c.SyncInterval <= 0 {
 		c.SyncInterval = defaultSyncInterval
 	}
+	if c.SyncJitter < 0 {
+		c.SyncJitter = 0
+	} else if c.SyncJitter > 1 {
+		c.SyncJitter = 1
+	}
+	if c.MaxRetryDelay <= 0 {
+		c.MaxRetryDelay = defaultMaxRetryDelay
+	}
+	if c.Backoff == nil {
+		c.Backoff = &ExponentialBackoff{Base: c.RetryDelay, Max: c.MaxRetryDelay, Jitter: true}
+	}
+	if c.HealthCheck != nil {
+		c.HealthCheck.setDefaults()
+	}
+	if c.CanaryPercent > 100 {
+		c.CanaryPercent = 100
+	}
+	if c.MinEndpoints <= 0 {
+		c.MinEndpoints = 1
+	}
+	if c.Resolver == nil {
+		c.Resolver = net.DefaultResolver
+	}
+	if c.RetryableError == nil {
+		c.RetryableError = retryable
+	}
+	if c.ParseCapacity == nil {
+		c.ParseCapacity = strconv.Atoi
+	}
 }
 
-func (lb *LoadBalancer) update(endpoints []Endpoint) {
-	lb.mu.Lock()
-	lb.endpoints = endpoints
-	lb.mu.Unlock()
+// newDefaultClient returns the client used when Config.Client is nil. It
+// honors the proxy environment variables and bounds connecting and waiting
+// for response headers, but not reading bodies, which would cut watches
+// short.
+func newDefaultClient(tlsConfig *tls.Config) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   defaultDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+			ResponseHeaderTimeout: defaultResponseHeaderTimeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          100,
+			ForceAttemptHTTP2:     true,
+		},
+	}
 }
 
-func (lb *LoadBalancer) reconcile() {
-	defer lb.wg.Done()
-	for {
-		select {
-		case <-time.After(lb.syncInterval):
-			err := lb.syncEndpoints()
-			if err != nil {
-				lb.errorLog.Println(err)
-			}
+// detectNamespace returns the namespace of the running pod, or an empty
+// string if it cannot be determined.
+func detectNamespace() string {
+	data, err := ioutil.ReadFile(namespaceFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// apply formats an Endpoints object received from the API and makes its
+// endpoints current.
+func (lb *LoadBalancer) apply(eps endpoints, source string) {
+	lb.applyMu.Lock()
+	defer lb.applyMu.Unlock()
+	lb.lastObject = &eps
+	lb.lastObjectSource = source
+	lb.applyLocked(eps, source)
+}
+
+// reapply formats the last Endpoints object again, picking up state that
+// changed since it was received, such as resolved hostnames.
+func (lb *LoadBalancer) reapply() {
+	lb.applyMu.Lock()
+	defer lb.applyMu.Unlock()
+	lb.formatted = nil
+	if lb.lastObject != nil {
+		lb.applyLocked(*lb.lastObject, lb.lastObjectSource)
+	}
+}
+
+// applyLocked does the work of apply. lb.applyMu must be held.
+func (lb *LoadBalancer) applyLocked(eps endpoints, source string) {
+	lb.mu.Lock()
+	lb.recordShape(eps)
+	lb.mu.Unlock()
+	lb.update(lb.formatCached(eps), source)
+}
+
+// formatCacheSize is the number of resource versions whose formatted
+// endpoints are kept by formatCached.
+const formatCacheSize = 4
+
+type formattedVersion struct {
+	resourceVersion string
+	endpoints       []Endpoint
+}
+
+// formatCached returns the formatted endpoints of eps, reusing the result
+// of an earlier call for the same resourceVersion so that objects
+// redelivered after a watch reconnect are not parsed again. The result is
+// a copy the caller may modify. lb.applyMu must be held.
+func (lb *LoadBalancer) formatCached(eps endpoints) []Endpoint {
+	version := eps.Metadata.ResourceVersion
+	if version == "" {
+		return lb.formatEndpoints(eps)
+	}
+	for _, f := range lb.formatted {
+		if f.resourceVersion == version {
+			return append([]Endpoint(nil), f.endpoints...)
+		}
+	}
+	formatted := lb.formatEndpoints(eps)
+	if len(lb.formatted) == formatCacheSize {
+		lb.formatted = lb.formatted[1:]
+	}
+	cached := append([]Endpoint(nil), formatted...)
+	lb.formatted = append(lb.formatted, formattedVersion{version, cached})
+	return formatted
+}
+
+func (lb *LoadBalancer) update(endpoints []Endpoint, source string) {
+	endpoints, omitted := sampleEndpoints(endpoints, lb.maxEndpoints)
+	sortEndpoints(endpoints)
+	applyZoneBalance(endpoints, lb.zoneBalance)
+	if lb.weightFunc != nil {
+		for i := range endpoints {
+			endpoints[i].Weight *= lb.weightFunc(endpoints[i])
+		}
+	}
+
+	lb.mu.Lock()
+	old := lb.endpoints
+	lb.endpoints = endpoints
+	lb.weighted = !uniformWeights(endpoints)
+	lb.prune()
+	now := lb.now()
+	if lb.minStableDuration > 0 {
+		lb.recordFirstSeen(now)
+	}
+	lb.lastUpdateSource = source
+	lb.lastUpdateAt = now
+	lb.synced = true
+	lb.stats.OmittedEndpoints = omitted
+	close(lb.updated)
+	lb.updated = make(chan struct{})
+	lb.mu.Unlock()
+
+	if !equalEndpoints(old, endpoints) {
+		if lb.onPortChange != nil {
+			lb.notifyPortChanges(old, endpoints)
+		}
+		lb.emitChanges(old, endpoints)
+		lb.notifyChange(old, endpoints)
+	}
+}
+
+// sortEndpoints sorts endpoints by host and then port, so that the order
+// Endpoints returns and Next walks through does not change when the API
+// server lists the same endpoints in a different order.
+func sortEndpoints(endpoints []Endpoint) {
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		a, b := endpoints[i], endpoints[j]
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		// Decimal ports compare numerically by length first.
+		if len(a.Port) != len(b.Port) {
+			return len(a.Port) < len(b.Port)
+		}
+		return a.Port < b.Port
+	})
+}
+
+// sampleEndpoints returns at most max of endpoints, keeping those whose keys
+// hash lowest in their original order, and the number left out. max <= 0
+// keeps every endpoint.
+func sampleEndpoints(endpoints []Endpoint, max int) ([]Endpoint, int) {
+	if max <= 0 || len(endpoints) <= max {
+		return endpoints, 0
+	}
+	hashes := make([]uint64, len(endpoints))
+	for i, ep := range endpoints {
+		h := fnv.New64a()
+		io.WriteString(h, ep.key())
+		hashes[i] = h.Sum64()
+	}
+	sorted := append([]uint64(nil), hashes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	cutoff := sorted[max-1]
+
+	kept := make([]Endpoint, 0, max)
+	for i, ep := range endpoints {
+		if hashes[i] <= cutoff && len(kept) < max {
+			kept = append(kept, ep)
+		}
+	}
+	return kept, len(endpoints) - len(kept)
+}
+
+// equalEndpoints reports whether a and b hold the same endpoints with the
+// same attributes, in any order.
+func equalEndpoints(a, b []Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	byKey := make(map[string]Endpoint, len(a))
+	for _, ep := range a {
+		byKey[ep.key()] = ep
+	}
+	for _, ep := range b {
+		prev, ok := byKey[ep.key()]
+		if !ok || !equalEndpoint(prev, ep) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalEndpoint(a, b Endpoint) bool {
+	return a.Host == b.Host && a.Port == b.Port &&
+		equalPorts(a.Ports, b.Ports) && equalPorts(a.Protocols, b.Protocols) &&
+		equalPorts(a.PortProtocols, b.PortProtocols) && equalPortList(a.AllPorts, b.AllPorts) &&
+		a.Namespace == b.Namespace && a.NodeName == b.NodeName && a.Hostname == b.Hostname && a.Zone == b.Zone && a.Weight == b.Weight &&
+		a.MaintenanceUntil.Equal(b.MaintenanceUntil) && a.Ready == b.Ready
+}
+
+// recordFirstSeen records when each current endpoint was first seen.
+// Endpoints present in the first update predate the LoadBalancer and are
+// treated as already stable. lb.mu must be held.
+func (lb *LoadBalancer) recordFirstSeen(now time.Time) {
+	if lb.firstSeen == nil {
+		lb.firstSeen = make(map[string]time.Time)
+		now = time.Time{}
+	}
+	for _, ep := range lb.endpoints {
+		key := ep.key()
+		if _, ok := lb.firstSeen[key]; !ok {
+			lb.firstSeen[key] = now
+		}
+	}
+}
+
+// prune drops the per-endpoint bookkeeping of endpoints that are no longer
+// present, keeping memory bounded by the live set as endpoints churn.
+// lb.mu must be held.
+func (lb *LoadBalancer) prune() {
+	live := make(map[string]bool, len(lb.endpoints))
+	for _, ep := range lb.endpoints {
+		live[ep.key()] = true
+	}
+	for key := range lb.unhealthy {
+		if !live[key] {
+			delete(lb.unhealthy, key)
+		}
+	}
+	for key := range lb.firstSeen {
+		if !live[key] {
+			delete(lb.firstSeen, key)
+		}
+	}
+	for key := range lb.currentWeights {
+		if !live[key] {
+			delete(lb.currentWeights, key)
+		}
+	}
+	for key := range lb.endpointStats {
+		if !live[key] {
+			delete(lb.endpointStats, key)
+		}
+	}
+}
+
+// notifyPortChanges calls the OnPortChange hook for every host present in
+// both old and endpoints whose ports differ. A host taken from several
+// subsets has one endpoint per subset, so its ports are combined across
+// them first.
+func (lb *LoadBalancer) notifyPortChanges(old, endpoints []Endpoint) {
+	previous := portsByHost(old)
+	current := portsByHost(endpoints)
+	notified := make(map[string]bool)
+	for _, ep := range endpoints {
+		if notified[ep.Host] {
+			continue
+		}
+		notified[ep.Host] = true
+		cur := current[ep.Host]
+		prev, ok := previous[ep.Host]
+		if !ok || (equalPorts(prev.defaults, cur.defaults) && equalPorts(prev.named, cur.named)) {
+			continue
+		}
+		lb.onPortChange(ep, prev.named, cur.named)
+	}
+}
+
+// hostPorts holds the ports of all endpoints sharing a host.
+type hostPorts struct {
+	defaults map[string]string // default ports, as a set
+	named    map[string]string // named ports, combined
+}
+
+func portsByHost(endpoints []Endpoint) map[string]*hostPorts {
+	hosts := make(map[string]*hostPorts)
+	for _, ep := range endpoints {
+		h, ok := hosts[ep.Host]
+		if !ok {
+			h = &hostPorts{
+				defaults: make(map[string]string),
+				named:    make(map[string]string),
+			}
+			hosts[ep.Host] = h
+		}
+		h.defaults[ep.Port] = ep.Port
+		for name, port := range ep.Ports {
+			h.named[name] = port
+		}
+	}
+	return hosts
+}
+
+func equalPorts(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, port := range a {
+		if p, ok := b[name]; !ok || p != port {
+			return false
+		}
+	}
+	return true
+}
+
+func equalPortList(a, b []Port) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (lb *LoadBalancer) reconcile() {
+	attempt := 0
+	delay := lb.jitteredSyncInterval()
+	for {
+		select {
+		case <-time.After(delay):
+			err := lb.syncEndpoints(context.Background())
+			if err != nil {
+				lb.logError(err, "endpoints reconcile failed")
+				attempt++
+				delay = lb.retryDelay(attempt, err)
+				if lb.retryPolicy != nil {
+					delay = lb.jitteredSyncInterval()
+				}
+				continue
+			}
+			attempt = 0
+			delay = lb.jitteredSyncInterval()
+			lb.backoff.Reset()
 		case <-lb.quit:
 			return
 		}
 	}
 }
 
-func (lb *LoadBalancer) syncEndpoints() error {
-	var eps endpoints
-	r, err := lb.get(context.TODO(), fmt.Sprintf(endpointsPath, lb.namespace, lb.service))
+// jitteredSyncInterval returns SyncInterval randomized by SyncJitter.
+func (lb *LoadBalancer) jitteredSyncInterval() time.Duration {
+	if lb.syncJitter == 0 {
+		return lb.syncInterval
+	}
+	factor := 1 + lb.syncJitter*(2*rand.Float64()-1)
+	return time.Duration(float64(lb.syncInterval) * factor)
+}
+
+// syncEndpoints lists the endpoints, retrying failed attempts as long as
+// RetryPolicy asks to.
+func (lb *LoadBalancer) syncEndpoints(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		err := lb.syncOnce(ctx)
+		if err == nil || lb.retryPolicy == nil {
+			return err
+		}
+		retry, delay := lb.retryPolicy(attempt, err)
+		if !retry {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		case <-lb.quit:
+			return err
+		}
+	}
+}
+
+// syncOnce makes a single attempt to list and apply the endpoints.
+func (lb *LoadBalancer) syncOnce(ctx context.Context) error {
+	start := time.Now()
+	code, err := lb.list(ctx)
+	if lb.onSyncComplete != nil {
+		lb.onSyncComplete(code, time.Since(start), err)
+	}
+	lb.recordSync(err)
 	if err != nil {
+		lb.emit(SyncFailed, err.Error(), Endpoint{})
 		return err
 	}
-	defer r.Close()
+	lb.emit(SyncSucceeded, "", Endpoint{})
+	return nil
+}
 
-	err = json.NewDecoder(r).Decode(&eps)
+// list fetches and applies the Endpoints object of the service, returning
+// the status code of the response or zero if none was received.
+func (lb *LoadBalancer) list(ctx context.Context) (int, error) {
+	if lb.apiRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lb.apiRequestTimeout)
+		defer cancel()
+	}
+	path := lb.listPath()
+
+	var eps endpoints
+	r, err := lb.get(ctx, path)
 	if err != nil {
-		return err
+		if e, ok := err.(*SyncError); ok {
+			if e.Code == http.StatusNotFound {
+				lb.setServiceExists(false)
+				lb.apply(endpoints{}, sourceReconcile)
+			}
+			return e.Code, err
+		}
+		return 0, err
 	}
+	defer r.Close()
 
-	lb.update(formatEndpoints(eps))
-	return nil
+	exists := true
+	if lb.useEndpointSlices {
+		var list endpointSliceList
+		err = lb.decode(r, path, &list, "EndpointSliceList")
+		lb.recordParse(err)
+		if err != nil {
+			return http.StatusOK, err
+		}
+		eps = lb.replaceSlices(list)
+		exists = len(eps.Subsets) > 0
+	} else if lb.multiNamespace() {
+		var list endpointsList
+		err = lb.decode(r, path, &list, "EndpointsList")
+		lb.recordParse(err)
+		if err != nil {
+			return http.StatusOK, err
+		}
+		eps = lb.replaceNamespaces(list)
+		exists = len(lb.byNamespace) > 0
+	} else {
+		err = lb.decode(r, path, &eps, "Endpoints")
+		lb.recordParse(err)
+		if err != nil {
+			return http.StatusOK, err
+		}
+	}
+
+	lb.setServiceExists(exists)
+	lb.setResourceVersion(eps.Metadata.ResourceVersion)
+	lb.apply(eps, sourceReconcile)
+	return http.StatusOK, nil
+}
+
+// setServiceExists records whether the service exists, calling
+// OnServiceDeleted if it existed until now.
+func (lb *LoadBalancer) setServiceExists(exists bool) {
+	lb.mu.Lock()
+	deleted := lb.serviceExists && !exists
+	lb.serviceExists = exists
+	lb.mu.Unlock()
+	if deleted && lb.onServiceDeleted != nil {
+		lb.onServiceDeleted()
+	}
+}
+
+func (lb *LoadBalancer) setResourceVersion(version string) {
+	lb.mu.Lock()
+	lb.resourceVersion = version
+	lb.mu.Unlock()
+}
+
+// watchPath returns path with the resourceVersion to resume watching from,
+// if one is known.
+func (lb *LoadBalancer) watchPath(path string) string {
+	lb.mu.RLock()
+	version := lb.resourceVersion
+	lb.mu.RUnlock()
+	if version == "" {
+		return path
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "resourceVersion=" + url.QueryEscape(version)
+}
+
+// relist lists the endpoints again after the API server reported that the
+// resource version the watch resumes from is too old.
+func (lb *LoadBalancer) relist(ctx context.Context) {
+	lb.setResourceVersion("")
+	if err := lb.syncEndpoints(ctx); err != nil {
+		lb.logError(err, "endpoints relist failed")
+	}
 }
 
 func (lb *LoadBalancer) watchEndpoints() {
-	defer lb.wg.Done()
 
 	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(context.Background())
 
-	wg.Add(1)
-	go lb.watch(ctx, &wg)
+	// Decoded objects are handed to a separate applier through a queue
+	// holding only the latest object. When applying falls behind,
+	// intermediate states are dropped but the latest is always applied.
+	pending := make(chan watchUpdate, 1)
+
+	lb.goTracked(&wg, func() { lb.watch(ctx, pending) })
+	lb.goTracked(&wg, func() { lb.applyPending(ctx, pending) })
 
 	<-lb.quit
 	cancel()
 	wg.Wait()
 }
 
-func (lb *LoadBalancer) watch(ctx context.Context, wg *sync.WaitGroup) {
-	defer wg.Done()
-	path := fmt.Sprintf(endpointsWatchPath, lb.namespace, lb.service)
+func (lb *LoadBalancer) watch(ctx context.Context, pending chan watchUpdate) {
+	path := lb.watchBasePath()
+	if lb.watchTimeout > 0 {
+		seconds := int64(lb.watchTimeout.Round(time.Second) / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + "timeoutSeconds=" + strconv.FormatInt(seconds, 10)
+	}
 
+	attempt := 0
+	connected := false
 	for {
-		r, err := lb.get(ctx, path)
+		r, err := lb.get(ctx, lb.watchPath(path))
 		if ctx.Err() == context.Canceled {
+			if r != nil {
+				r.Close()
+			}
 			return
 		}
-		if err != nil {
-			lb.errorLog.Println(err)
-			time.Sleep(lb.retryDelay)
+		lb.recordSync(err)
+		if e, ok := err.(*SyncError); ok && e.Code == http.StatusGone {
+			lb.logError(err, "endpoints watch expired", "path", path)
+			lb.relist(ctx)
 			continue
 		}
-
-		// endpoint watches return a stream of JSON objects which
-		// must be processed one at a time to ensure consistency.
-		decoder := json.NewDecoder(r)
-		for {
-			if ctx.Err() == context.Canceled {
-				r.Close()
+		if err != nil {
+			lb.logError(err, "endpoints watch failed", "path", path)
+			attempt++
+			retry, delay := lb.watchRetry(attempt, err)
+			if !retry {
+				lb.logError(fmt.Errorf("endpoints watch %s: giving up after %d attempts", path, attempt),
+					"endpoints watch gave up", "path", path, "attempts", attempt)
+				if lb.onWatchGaveUp != nil {
+					lb.onWatchGaveUp(err)
+				}
+				return
+			}
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
 				return
 			}
+			continue
+		}
+		attempt = 0
+		lb.backoff.Reset()
+		if connected {
+			lb.recordReconnect()
+			lb.emit(WatchReconnected, path, Endpoint{})
+			if lb.onWatchReconnected != nil {
+				lb.onWatchReconnected()
+			}
+		}
+		connected = true
 
-			var o object
-			err := decoder.Decode(&o)
-			if err != nil {
-				lb.errorLog.Printf("endpoints watch %s: %s", path, err)
-				r.Close()
-				break
+		lb.watchStream(ctx, path, r, pending)
+	}
+}
+
+// A watchUpdate is an object decoded from the watch waiting to be applied.
+type watchUpdate struct {
+	object endpoints
+	synced bool // the first event of a watch connection
+}
+
+func (lb *LoadBalancer) applyPending(ctx context.Context, pending <-chan watchUpdate) {
+	for {
+		select {
+		case u := <-pending:
+			lb.apply(u.object, sourceWatch)
+			if u.synced && lb.onWatchSynced != nil {
+				lb.onWatchSynced()
 			}
-			if o.Type == "ERROR" {
-				lb.errorLog.Printf("endpoints watch %s: %s", path, o.Object.Message)
-				r.Close()
-				break
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// enqueue replaces any update waiting in pending with u, carrying over
+// whether the replaced update completed a watch sync.
+func enqueue(pending chan watchUpdate, u watchUpdate) {
+	for {
+		select {
+		case pending <- u:
+			return
+		default:
+		}
+		select {
+		case old := <-pending:
+			u.synced = u.synced || old.synced
+		default:
+		}
+	}
+}
+
+// watchStream processes the watch events read from r until the stream ends,
+// an error event is received, or ctx is canceled. r is closed on every exit
+// path so repeated reconnects do not leak connections.
+func (lb *LoadBalancer) watchStream(ctx context.Context, path string, r io.ReadCloser, pending chan watchUpdate) {
+	defer r.Close()
+
+	// endpoint watches return a stream of JSON objects which
+	// must be processed one at a time to ensure consistency.
+	decoder := lb.newDecoder(r)
+	first := true
+	for {
+		if ctx.Err() == context.Canceled {
+			return
+		}
+
+		o, err := lb.decodeEvent(decoder)
+		if err == io.EOF || (err != nil && ctx.Err() != nil) {
+			// The API server ended the watch, such as when its timeout
+			// expired, or the LoadBalancer is shutting down. Either is
+			// expected and not logged.
+			return
+		}
+		if isParseError(err) {
+			err = newDecodeError(path, decoder.Buffered(), err)
+		} else if err != nil {
+			err = fmt.Errorf("endpoints watch %s: %w", path, err)
+		}
+		lb.recordParse(err)
+		if err != nil {
+			lb.logError(err, "endpoints watch ended", "path", path)
+			return
+		}
+		if o.Type == "ERROR" {
+			lb.logError(fmt.Errorf("endpoints watch %s: %s", path, o.Object.Message),
+				"endpoints watch error event", "path", path, "code", o.Object.Code)
+			if o.Object.Code == http.StatusGone {
+				lb.relist(ctx)
 			}
-			lb.update(formatEndpoints(o.Object))
+			return
 		}
+		if o.Type == "DELETED" {
+			// The service was deleted; its endpoints go with it.
+			o.Object.Subsets = nil
+		}
+		lb.setServiceExists(o.Type != "DELETED")
+		lb.setResourceVersion(o.Object.Metadata.ResourceVersion)
+		enqueue(pending, watchUpdate{o.Object, first})
+		first = false
+	}
+}
+
+// decodeEvent decodes the next watch event. Events of an EndpointSlice
+// watch, or of a watch spanning several namespaces, are merged with the
+// other objects of the service into an event carrying the combined
+// Endpoints object.
+func (lb *LoadBalancer) decodeEvent(decoder *json.Decoder) (object, error) {
+	var o object
+	if !lb.useEndpointSlices {
+		err := decoder.Decode(&o)
+		if err == nil && o.Type != "ERROR" && lb.multiNamespace() {
+			var remaining bool
+			o.Object, remaining = lb.applyNamespaceEvent(o)
+			o.Type = mergedEventType(o.Type, remaining)
+		}
+		return o, err
+	}
+
+	var so sliceObject
+	err := decoder.Decode(&so)
+	if err != nil {
+		return o, err
+	}
+	if so.Type == "ERROR" {
+		o.Type = so.Type
+		o.Object.Message, o.Object.Code = so.Object.Message, so.Object.Code
+		return o, nil
+	}
+	var remaining bool
+	o.Object, remaining = lb.applySliceEvent(so)
+	o.Type = mergedEventType(so.Type, remaining)
+	return o, nil
+}
+
+// mergedEventType returns the type of an event carrying a combined
+// Endpoints object: "DELETED" if the event deleted the last object of the
+// service, and "MODIFIED" otherwise.
+func mergedEventType(eventType string, remaining bool) string {
+	if eventType == "DELETED" && !remaining {
+		return "DELETED"
+	}
+	return "MODIFIED"
+}
+
+// newDecoder returns a JSON decoder for Kubernetes API responses, rejecting
+// unknown fields when StrictJSON is set.
+func (lb *LoadBalancer) newDecoder(r io.Reader) *json.Decoder {
+	decoder := json.NewDecoder(r)
+	if lb.strictJSON {
+		decoder.DisallowUnknownFields()
 	}
+	return decoder
 }
 
 // SyncError records an error during an Kubernetes API call and the HTTP
@@ -305,6 +1986,15 @@ type SyncError struct {
 	URL     string // URL used
 	Message string // description of the error
 	Code    int    // remote status code
+
+	// Reason is the machine-readable reason of the Kubernetes Status
+	// returned with the error, such as "NotFound" or "Forbidden", or empty
+	// if the response did not carry one.
+	Reason string
+
+	// RetryAfter is the delay requested by the API server through the
+	// Retry-After header, such as on a 429 response, or zero.
+	RetryAfter time.Duration
 }
 
 func (e *SyncError) Error() string {
@@ -312,18 +2002,30 @@ func (e *SyncError) Error() string {
 }
 
 func (lb *LoadBalancer) get(ctx context.Context, path string) (io.ReadCloser, error) {
+	path, query, _ := strings.Cut(path, "?")
 	r := &http.Request{
 		Header: make(http.Header),
 		Method: http.MethodGet,
 		URL: &url.URL{
-			Host:   lb.apiAddr,
-			Path:   path,
-			Scheme: "http",
+			Host:     lb.apiAddr,
+			Path:     path,
+			RawQuery: query,
+			Scheme:   lb.scheme,
 		},
 	}
-	r.Header.Set("Accept", "application/json, */*")
+	r.Header.Set("Accept", lb.accept)
+	token, err := lb.token()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
 
 	url := r.URL.String()
+	if lb.onRequest != nil {
+		lb.onRequest(r.Method, url)
+	}
 
 	resp, err := lb.client.Do(r.WithContext(ctx))
 	if err != nil {
@@ -331,47 +2033,268 @@ func (lb *LoadBalancer) get(ctx context.Context, path string) (io.ReadCloser, er
 	}
 
 	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		e := &SyncError{
+			URL:        url,
+			Code:       resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), lb.now()),
+		}
 		d, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return nil, &SyncError{url, err.Error(), resp.StatusCode}
+			e.Message = err.Error()
+			return nil, e
 		}
 
 		// Decode the remote error.
 		var s status
 		err = json.Unmarshal(d, &s)
 		if err != nil {
-			return nil, &SyncError{url, err.Error(), resp.StatusCode}
+			e.Message = err.Error()
+			return nil, e
+		}
+		e.Message, e.Reason = s.Message, s.Reason
+		if s.Code != 0 {
+			e.Code = s.Code
 		}
-		return nil, &SyncError{url, s.Message, s.Code}
+		return nil, e
 	}
 
 	return resp.Body, nil
 }
 
-func formatEndpoints(endpoints endpoints) []Endpoint {
+// parseRetryAfter parses a Retry-After header given either in seconds or as
+// an HTTP date, which is taken relative to now. It returns zero if the
+// header is missing or invalid.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		return 0
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// watchRetry reports whether to reconnect the watch after the given
+// failed attempt, and how long to wait before doing so.
+func (lb *LoadBalancer) watchRetry(attempt int, err error) (bool, time.Duration) {
+	if lb.retryPolicy != nil {
+		return lb.retryPolicy(attempt, err)
+	}
+	if lb.maxWatchReconnects > 0 && attempt >= lb.maxWatchReconnects {
+		return false, 0
+	}
+	return true, lb.retryDelay(attempt, err)
+}
+
+// retryDelay returns how long to wait before the given retry attempt after
+// err, honoring a longer delay requested by the API server. Errors that are
+// not retryable wait for the next regular sync.
+func (lb *LoadBalancer) retryDelay(attempt int, err error) time.Duration {
+	code := 0
+	if e, ok := err.(*SyncError); ok {
+		code = e.Code
+	}
+	if !lb.retryableError(err, code) {
+		return lb.syncInterval
+	}
+	d := lb.backoff.Next(attempt)
+	if e, ok := err.(*SyncError); ok && e.RetryAfter > d {
+		d = e.RetryAfter
+	}
+	return d
+}
+
+// retryable is the default RetryableError. Errors without a status code,
+// such as connection errors, are retried, as are 429 and 5xx responses.
+func retryable(err error, statusCode int) bool {
+	return statusCode == 0 || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+func (lb *LoadBalancer) formatEndpoints(endpoints endpoints) []Endpoint {
 	eps := make([]Endpoint, 0)
-	if len(endpoints.Subsets) == 0 {
-		return eps
+
+	var gated map[string]bool
+	if lb.readinessAnnotation != "" {
+		gated = parseReadinessAnnotation(endpoints.Metadata.Annotations[lb.readinessAnnotation])
+	}
+	var maintenance map[string]time.Time
+	if lb.maintenanceKey != "" {
+		maintenance = parseMaintenanceAnnotation(endpoints.Metadata.Annotations[lb.maintenanceKey])
 	}
 
+	hostnames := make(map[string]bool)
+	for i, subset := range endpoints.Subsets {
+		if subset.namespace == "" {
+			subset.namespace = endpoints.Metadata.Namespace
+		}
+		if lb.subsetSelector != nil && !lb.subsetSelector(i, subsetPorts(subset)) {
+			continue
+		}
+		eps = lb.appendSubset(eps, subset, gated, maintenance, hostnames)
+	}
+	lb.pruneResolverCache(hostnames)
+	return eps
+}
+
+// appendSubset appends an endpoint for every ready address of subset, and
+// every not-ready one if IncludeNotReady is set, to eps, recording the
+// hostnames it resolves in hostnames.
+func (lb *LoadBalancer) appendSubset(eps []Endpoint, subset subset, gated map[string]bool, maintenance map[string]time.Time, hostnames map[string]bool) []Endpoint {
 	port := ""
 	ports := make(map[string]string)
-	if len(endpoints.Subsets[0].Ports) > 0 {
-		port = strconv.FormatInt(int64(endpoints.Subsets[0].Ports[0].Port), 10)
-		for _, p := range endpoints.Subsets[0].Ports {
+	protocols := make(map[string]string)
+	portProtocols := make(map[string]string)
+	var allPorts []Port
+	if len(subset.Ports) > 0 {
+		port = strconv.FormatInt(int64(subset.Ports[0].Port), 10)
+		allPorts = make([]Port, len(subset.Ports))
+		for i, p := range subset.Ports {
+			protocol := p.Protocol
+			if protocol == "" {
+				protocol = "TCP"
+			}
+			allPorts[i] = Port{Name: p.Name, Number: int(p.Port), Protocol: protocol}
 			if p.Name != "" {
 				ports[p.Name] = strconv.FormatInt(int64(p.Port), 10)
+				if p.AppProtocol != "" {
+					protocols[p.Name] = p.AppProtocol
+				}
+				portProtocols[p.Name] = protocol
 			}
 		}
+		for _, name := range lb.preferredPortOrder {
+			if p, ok := ports[name]; ok {
+				port = p
+				break
+			}
+		}
+		if lb.requireExplicitPort {
+			port = ""
+		}
+	}
+
+	addresses := subset.Addresses
+	if lb.includeNotReady {
+		addresses = append(addresses[:len(addresses):len(addresses)], subset.NotReadyAddresses...)
 	}
+	for i, address := range addresses {
+		if gated != nil && !gated[address.IP] && !(address.TargetRef != nil && gated[address.TargetRef.Name]) {
+			continue
+		}
+
+		zone := address.zone
+		if zone == "" && lb.nodeZone != nil && address.NodeName != "" {
+			zone = lb.nodeZone(address.NodeName)
+		}
+		ready := i < len(subset.Addresses)
+		if lb.addressFilter != nil && !lb.addressFilter(publicAddress(address, subset.namespace, zone, ready)) {
+			continue
+		}
 
-	for _, address := range endpoints.Subsets[0].Addresses {
-		ep := Endpoint{
-			Host:  address.IP,
-			Port:  port,
-			Ports: ports,
+		// Addresses carrying only a hostname expand to one endpoint
+		// per resolved IP address.
+		hosts := []string{address.IP}
+		if address.IP == "" {
+			if address.Hostname == "" {
+				continue
+			}
+			hostnames[address.Hostname] = true
+			hosts = lb.lookupHost(address.Hostname)
+		}
+
+		for _, host := range hosts {
+			ep := Endpoint{
+				Host:          host,
+				Port:          port,
+				Ports:         ports,
+				AllPorts:      allPorts,
+				Protocols:     protocols,
+				PortProtocols: portProtocols,
+				Namespace:     subset.namespace,
+				NodeName:      address.NodeName,
+				Hostname:      address.Hostname,
+				Zone:          zone,
+				Weight:        1,
+				Ready:         ready,
+			}
+			if until, ok := maintenance[address.IP]; ok {
+				ep.MaintenanceUntil = until
+			} else if address.TargetRef != nil {
+				ep.MaintenanceUntil = maintenance[address.TargetRef.Name]
+			}
+			eps = append(eps, ep)
 		}
-		eps = append(eps, ep)
 	}
 	return eps
 }
+
+// publicAddress describes address for the AddressFilter.
+func publicAddress(address address, namespace, zone string, ready bool) Address {
+	a := Address{
+		Namespace: namespace,
+		IP:        address.IP,
+		Hostname:  address.Hostname,
+		NodeName:  address.NodeName,
+		Zone:      zone,
+		Ready:     ready,
+	}
+	if address.TargetRef != nil {
+		a.TargetKind = address.TargetRef.Kind
+		a.TargetName = address.TargetRef.Name
+	}
+	return a
+}
+
+// subsetPorts describes the ports of subset for the SubsetSelector.
+func subsetPorts(subset subset) []PortInfo {
+	ports := make([]PortInfo, len(subset.Ports))
+	for i, p := range subset.Ports {
+		ports[i] = PortInfo{
+			Name:        p.Name,
+			Port:        int(p.Port),
+			Protocol:    p.Protocol,
+			AppProtocol: p.AppProtocol,
+		}
+	}
+	return ports
+}
+
+// parseReadinessAnnotation returns the set of pod IPs and pod names listed
+// in a comma-separated readiness annotation value.
+func parseReadinessAnnotation(value string) map[string]bool {
+	ready := make(map[string]bool)
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			ready[v] = true
+		}
+	}
+	return ready
+}
+
+// parseMaintenanceAnnotation returns the end of the maintenance window of
+// each pod IP or pod name listed in a maintenance annotation value.
+func parseMaintenanceAnnotation(value string) map[string]time.Time {
+	windows := make(map[string]time.Time)
+	for _, v := range strings.Split(value, ",") {
+		i := strings.Index(v, "=")
+		if i < 0 {
+			continue
+		}
+		until, err := time.Parse(time.RFC3339, strings.TrimSpace(v[i+1:]))
+		if err != nil {
+			continue
+		}
+		windows[strings.TrimSpace(v[:i])] = until
+	}
+	return windows
+}
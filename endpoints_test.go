@@ -0,0 +1,1645 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A fakeClock is a clock for LoadBalancer.now that only moves when
+// advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// A fakeAPI is a Kubernetes API server serving the endpoints of a single
+// service. Requests are routed to the watch handler if they are watch
+// requests, and to the list handler otherwise.
+type fakeAPI struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []string // request URIs, in order
+	list     http.HandlerFunc
+	watch    http.HandlerFunc
+}
+
+// newFakeAPI starts a fakeAPI whose list handler serves object and whose
+// watch handler blocks until the request is canceled.
+func newFakeAPI(t *testing.T, object endpoints) *fakeAPI {
+	f := &fakeAPI{
+		list: func(w http.ResponseWriter, r *http.Request) { writeJSON(w, object) },
+		watch: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeAPI) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.URL.RequestURI())
+	list, watch := f.list, f.watch
+	f.mu.Unlock()
+	if strings.Contains(r.URL.Path, "/watch/") || r.URL.Query().Get("watch") == "true" {
+		watch(w, r)
+		return
+	}
+	list(w, r)
+}
+
+// setList replaces the list handler.
+func (f *fakeAPI) setList(h http.HandlerFunc) {
+	f.mu.Lock()
+	f.list = h
+	f.mu.Unlock()
+}
+
+// setWatch replaces the watch handler.
+func (f *fakeAPI) setWatch(h http.HandlerFunc) {
+	f.mu.Lock()
+	f.watch = h
+	f.mu.Unlock()
+}
+
+// requestURIs returns the URIs of the requests received so far.
+func (f *fakeAPI) requestURIs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// config returns a Config for the service "test" in the namespace
+// "default" served by f.
+func (f *fakeAPI) config() *Config {
+	return &Config{
+		APIAddr:   strings.TrimPrefix(f.URL, "http://"),
+		Namespace: "default",
+		Service:   "test",
+		ErrorLog:  log.New(ioutil.Discard, "", 0),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeEvent writes a watch event of the given type carrying eps and
+// flushes it to the client.
+func writeEvent(w http.ResponseWriter, eventType string, eps endpoints) {
+	json.NewEncoder(w).Encode(object{Type: eventType, Object: eps})
+	w.(http.Flusher).Flush()
+}
+
+// writeStatus writes a Kubernetes Status error response.
+func writeStatus(w http.ResponseWriter, code int, reason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status{Message: message, Reason: reason, Code: code})
+}
+
+// waitFor polls cond until it returns true, failing the test if it does
+// not within five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// endpointsObject returns an Endpoints object with the given resource
+// version and subsets.
+func endpointsObject(resourceVersion string, subsets ...subset) endpoints {
+	return endpoints{
+		Kind:       "Endpoints",
+		ApiVersion: "v1",
+		Metadata:   metadata{Name: "test", Namespace: "default", ResourceVersion: resourceVersion},
+		Subsets:    subsets,
+	}
+}
+
+// newStatic returns a LoadBalancer configured with config and primed with
+// eps.
+func newStatic(config *Config, eps ...Endpoint) *LoadBalancer {
+	lb := New(config)
+	lb.Prime(eps)
+	return lb
+}
+
+// newFromSubsets returns a LoadBalancer configured with config whose
+// endpoints are formatted from an Endpoints object holding subsets.
+func newFromSubsets(config *Config, subsets ...subset) *LoadBalancer {
+	lb := New(config)
+	lb.apply(endpoints{Subsets: subsets}, sourceReconcile)
+	return lb
+}
+
+// addresses returns an address for each of ips.
+func addresses(ips ...string) []address {
+	as := make([]address, len(ips))
+	for i, ip := range ips {
+		as[i] = address{IP: ip}
+	}
+	return as
+}
+
+// ep returns an endpoint with the given host and port.
+func ep(host, port string) Endpoint {
+	return Endpoint{Host: host, Port: port}
+}
+
+// weighted returns endpoint with its Weight set to weight.
+func weighted(endpoint Endpoint, weight int) Endpoint {
+	endpoint.Weight = weight
+	return endpoint
+}
+
+func TestNextExcept(t *testing.T) {
+	a, b, c := ep("10.0.0.1", "80"), ep("10.0.0.2", "80"), ep("10.0.0.3", "80")
+	tests := []struct {
+		name   string
+		config Config
+		eps    []Endpoint
+		avoid  []Endpoint
+		want   Endpoint
+	}{
+		{"round-robin", Config{}, []Endpoint{a, b}, []Endpoint{a}, b},
+		{"weighted", Config{}, []Endpoint{weighted(a, 10), weighted(b, 1)}, []Endpoint{a}, b},
+		{"strategy", Config{Strategy: RandomStrategy{}}, []Endpoint{a, b, c}, []Endpoint{a, c}, b},
+		{"canary", Config{
+			CanaryPredicate: func(e Endpoint) bool { return e.Host == a.Host },
+			CanaryPercent:   50,
+		}, []Endpoint{a, b}, []Endpoint{a}, b},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newStatic(&tt.config, tt.eps...)
+			for i := 0; i < 20; i++ {
+				got, err := lb.NextExcept(tt.avoid...)
+				if err != nil {
+					t.Fatalf("call %d: NextExcept() error = %v", i, err)
+				}
+				if got.Host != tt.want.Host {
+					t.Fatalf("call %d: NextExcept() = %s, want %s", i, got.Host, tt.want.Host)
+				}
+			}
+		})
+	}
+}
+
+func TestNextExceptJustReturned(t *testing.T) {
+	lb := newStatic(&Config{}, ep("10.0.0.1", "80"), ep("10.0.0.2", "80"), ep("10.0.0.3", "80"))
+	for i := 0; i < 10; i++ {
+		first, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := lb.NextExcept(first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second.Host == first.Host {
+			t.Fatalf("NextExcept(%s) returned the avoided endpoint", first.Host)
+		}
+	}
+}
+
+func TestNextExceptAllAvoided(t *testing.T) {
+	a, b := ep("10.0.0.1", "80"), ep("10.0.0.2", "80")
+	lb := newStatic(&Config{}, a, b)
+	if _, err := lb.NextExcept(a, b); err != ErrNoEndpoints {
+		t.Fatalf("NextExcept() error = %v, want %v", err, ErrNoEndpoints)
+	}
+}
+
+func TestNextForPortProtocol(t *testing.T) {
+	grpc := subset{
+		Addresses: addresses("10.0.0.1"),
+		Ports:     []port{{Name: "http", Port: 8080}, {Name: "grpc", Port: 9000}},
+	}
+	dns := subset{
+		Addresses: addresses("10.0.0.2"),
+		Ports:     []port{{Name: "http", Port: 8080}, {Name: "grpc", Port: 9001, Protocol: "UDP"}},
+	}
+	for _, config := range []Config{{}, {Strategy: RandomStrategy{}}} {
+		lb := newFromSubsets(&config, grpc, dns)
+		for i := 0; i < 10; i++ {
+			got, err := lb.NextForPortProtocol("grpc", "udp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Host != "10.0.0.2" || got.Port != "9001" {
+				t.Fatalf("NextForPortProtocol(grpc, udp) = %s:%s, want 10.0.0.2:9001", got.Host, got.Port)
+			}
+		}
+		if _, err := lb.NextForPortProtocol("http", "udp"); !errors.Is(err, ErrPortNotFound) {
+			t.Fatalf("NextForPortProtocol(http, udp) error = %v, want %v", err, ErrPortNotFound)
+		}
+	}
+}
+
+func TestNextForPortNonRoundRobin(t *testing.T) {
+	subsets := []subset{{
+		Addresses: addresses("10.0.0.1"),
+		Ports:     []port{{Name: "http", Port: 8080}, {Name: "grpc", Port: 9000}},
+	}}
+	for i := 2; i <= 10; i++ {
+		subsets = append(subsets, subset{
+			Addresses: addresses(fmt.Sprintf("10.0.0.%d", i)),
+			Ports:     []port{{Name: "http", Port: 8080}},
+		})
+	}
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"strategy", Config{Strategy: RandomStrategy{}}},
+		{"weighted", Config{WeightFunc: func(e Endpoint) int {
+			if e.Host == "10.0.0.1" {
+				return 1
+			}
+			return 10
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newFromSubsets(&tt.config, subsets...)
+			for i := 0; i < 200; i++ {
+				got, err := lb.NextForPort("grpc")
+				if err != nil {
+					t.Fatalf("call %d: NextForPort() error = %v", i, err)
+				}
+				if got.Host != "10.0.0.1" || got.Port != "9000" {
+					t.Fatalf("NextForPort() = %s:%s, want 10.0.0.1:9000", got.Host, got.Port)
+				}
+			}
+		})
+	}
+}
+
+func TestNextMultiPort(t *testing.T) {
+	both := subset{
+		Addresses: addresses("10.0.0.1"),
+		Ports:     []port{{Name: "http", Port: 8080}, {Name: "metrics", Port: 9090}},
+	}
+	httpOnly := subset{
+		Addresses: addresses("10.0.0.2", "10.0.0.3"),
+		Ports:     []port{{Name: "http", Port: 8081}},
+	}
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"round-robin", Config{}},
+		{"strategy", Config{Strategy: RandomStrategy{}}},
+		{"weighted", Config{WeightFunc: func(e Endpoint) int {
+			if e.Host == "10.0.0.1" {
+				return 1
+			}
+			return 10
+		}}},
+		{"canary", Config{
+			CanaryPredicate: func(e Endpoint) bool { return e.Host == "10.0.0.1" },
+			CanaryPercent:   10,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newFromSubsets(&tt.config, both, httpOnly)
+			for i := 0; i < 50; i++ {
+				got, ports, err := lb.NextMultiPort("http", "metrics")
+				if err != nil {
+					t.Fatalf("call %d: NextMultiPort() error = %v", i, err)
+				}
+				if got.Host != "10.0.0.1" {
+					t.Fatalf("NextMultiPort() = %s, want 10.0.0.1", got.Host)
+				}
+				want := map[string]string{"http": "8080", "metrics": "9090"}
+				if !equalPorts(ports, want) {
+					t.Fatalf("NextMultiPort() ports = %v, want %v", ports, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNextMultiPortMissing(t *testing.T) {
+	lb := newFromSubsets(&Config{}, subset{
+		Addresses: addresses("10.0.0.1"),
+		Ports:     []port{{Name: "http", Port: 8080}},
+	})
+	_, _, err := lb.NextMultiPort("http", "metrics")
+	if !errors.Is(err, ErrPortNotFound) || !strings.Contains(err.Error(), "metrics") {
+		t.Fatalf("NextMultiPort() error = %v, want %v naming metrics", err, ErrPortNotFound)
+	}
+}
+
+func TestAppProtocol(t *testing.T) {
+	lb := newFromSubsets(&Config{}, subset{
+		Addresses: addresses("10.0.0.1"),
+		Ports: []port{
+			{Name: "http", Port: 8080, AppProtocol: "http"},
+			{Name: "grpc", Port: 9090, AppProtocol: "grpc"},
+		},
+	})
+	got, err := lb.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"http": "http", "grpc": "grpc", "metrics": ""} {
+		if p := got.AppProtocol(name); p != want {
+			t.Errorf("AppProtocol(%q) = %q, want %q", name, p, want)
+		}
+	}
+	if want := map[string]string{"http": "8080", "grpc": "9090"}; !equalPorts(got.Ports, want) {
+		t.Errorf("Ports = %v, want %v", got.Ports, want)
+	}
+}
+
+func TestOnPortChange(t *testing.T) {
+	type change struct {
+		host     string
+		old, new map[string]string
+	}
+	var changes []change
+	lb := New(&Config{OnPortChange: func(ep Endpoint, old, new map[string]string) {
+		changes = append(changes, change{ep.Host, old, new})
+	}})
+
+	lb.apply(endpoints{Subsets: []subset{{
+		Addresses: addresses("10.0.0.1", "10.0.0.2"),
+		Ports:     []port{{Name: "http", Port: 8080}},
+	}}}, sourceReconcile)
+	lb.apply(endpoints{Subsets: []subset{{
+		Addresses: addresses("10.0.0.1", "10.0.0.2"),
+		Ports:     []port{{Name: "http", Port: 9090}},
+	}, {
+		Addresses: addresses("10.0.0.3"),
+		Ports:     []port{{Name: "http", Port: 8080}},
+	}}}, sourceReconcile)
+
+	if len(changes) != 2 {
+		t.Fatalf("OnPortChange called %d times, want 2: %v", len(changes), changes)
+	}
+	for i, host := range []string{"10.0.0.1", "10.0.0.2"} {
+		c := changes[i]
+		if c.host != host || c.old["http"] != "8080" || c.new["http"] != "9090" {
+			t.Errorf("change %d = %v, want %s http 8080 -> 9090", i, c, host)
+		}
+	}
+}
+
+func TestOnPortChangeSharedHost(t *testing.T) {
+	calls := 0
+	lb := New(&Config{OnPortChange: func(Endpoint, map[string]string, map[string]string) {
+		calls++
+	}})
+	object := endpoints{Subsets: []subset{{
+		Addresses: addresses("10.0.0.1"),
+		Ports:     []port{{Name: "http", Port: 8080}},
+	}, {
+		Addresses: addresses("10.0.0.1"),
+		Ports:     []port{{Name: "metrics", Port: 9090}},
+	}}}
+	for i := 0; i < 3; i++ {
+		lb.apply(object, sourceReconcile)
+	}
+	if calls != 0 {
+		t.Fatalf("OnPortChange called %d times for an unchanged object", calls)
+	}
+
+	object.Subsets[1].Ports[0].Port = 9091
+	lb.apply(object, sourceReconcile)
+	if calls != 1 {
+		t.Fatalf("OnPortChange called %d times after one port changed, want 1", calls)
+	}
+}
+
+func TestMaintenanceAnnotation(t *testing.T) {
+	const annotation = "example.com/maintenance"
+	clock := newFakeClock()
+	lb := New(&Config{MaintenanceAnnotation: annotation})
+	lb.now = clock.Now
+
+	until := clock.Now().Add(time.Hour)
+	lb.apply(endpoints{
+		Metadata: metadata{Annotations: map[string]string{
+			annotation: "10.0.0.1=" + until.Format(time.RFC3339),
+		}},
+		Subsets: []subset{{
+			Addresses: addresses("10.0.0.1", "10.0.0.2"),
+			Ports:     []port{{Port: 80}},
+		}},
+	}, sourceReconcile)
+
+	for i := 0; i < 4; i++ {
+		got, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Host != "10.0.0.2" {
+			t.Fatalf("Next() = %s during its maintenance window", got.Host)
+		}
+	}
+	if eps := lb.Endpoints(); len(eps) != 2 || !eps[0].MaintenanceUntil.Equal(until) {
+		t.Fatalf("Endpoints() = %v, want both endpoints with 10.0.0.1 in maintenance until %v", eps, until)
+	}
+
+	clock.Advance(time.Hour + time.Second)
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		got, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[got.Host] = true
+	}
+	if !seen["10.0.0.1"] {
+		t.Fatal("Next() never returned 10.0.0.1 after its maintenance window ended")
+	}
+}
+
+func TestReadinessAnnotation(t *testing.T) {
+	const annotation = "example.com/ready"
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []string
+	}{
+		{"absent", nil, nil},
+		{"not ready", map[string]string{annotation: "10.0.0.1"}, []string{"10.0.0.1"}},
+		{"ready", map[string]string{annotation: "10.0.0.1, pod-b"}, []string{"10.0.0.1", "10.0.0.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := New(&Config{ReadinessAnnotation: annotation})
+			lb.apply(endpoints{
+				Metadata: metadata{Annotations: tt.annotations},
+				Subsets: []subset{{
+					Addresses: []address{
+						{IP: "10.0.0.1", TargetRef: &objectReference{Kind: "Pod", Name: "pod-a"}},
+						{IP: "10.0.0.2", TargetRef: &objectReference{Kind: "Pod", Name: "pod-b"}},
+					},
+					Ports: []port{{Port: 80}},
+				}},
+			}, sourceReconcile)
+
+			var got []string
+			for _, e := range lb.Endpoints() {
+				got = append(got, e.Host)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Endpoints() hosts = %v, want %v", got, tt.want)
+			}
+			if len(tt.want) == 0 {
+				if _, err := lb.Next(); err != ErrNoEndpoints {
+					t.Fatalf("Next() error = %v, want ErrNoEndpoints", err)
+				}
+				return
+			}
+			if hosts := nextHosts(t, lb, 4); len(hosts) != len(tt.want) {
+				t.Fatalf("Next() returned %v, want only %v", hosts, tt.want)
+			}
+		})
+	}
+
+	lb := newFromSubsets(&Config{}, subset{Addresses: addresses("10.0.0.1", "10.0.0.2"), Ports: []port{{Port: 80}}})
+	if eps := lb.Endpoints(); len(eps) != 2 {
+		t.Fatalf("Endpoints() = %v without ReadinessAnnotation, want both addresses", eps)
+	}
+}
+
+func TestNextContextReleasesWaitersTogether(t *testing.T) {
+	lb := New(&Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const waiters = 50
+	var started, done sync.WaitGroup
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		started.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			started.Done()
+			_, err := lb.NextContext(ctx)
+			errs <- err
+		}()
+	}
+	started.Wait()
+	time.Sleep(10 * time.Millisecond)
+
+	lb.Prime([]Endpoint{ep("10.0.0.1", "80")})
+	done.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("NextContext() error = %v", err)
+		}
+	}
+}
+
+func TestNextContextCanceled(t *testing.T) {
+	lb := New(&Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := lb.NextContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("NextContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// A countingTransport counts the response bodies it opens and the ones
+// closed by the client.
+type countingTransport struct {
+	opened, closed int64 // accessed atomically
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&c.opened, 1)
+	resp.Body = &countingBody{ReadCloser: resp.Body, t: c}
+	return resp, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	t    *countingTransport
+	once sync.Once
+}
+
+func (b *countingBody) Close() error {
+	b.once.Do(func() { atomic.AddInt64(&b.t.closed, 1) })
+	return b.ReadCloser.Close()
+}
+
+func TestWatchClosesResponseBodies(t *testing.T) {
+	api := newFakeAPI(t, endpointsObject("1"))
+	var cycles int64
+	api.setWatch(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt64(&cycles, 1) % 4 {
+		case 0:
+			writeEvent(w, "MODIFIED", endpointsObject("2", subset{Addresses: addresses("10.0.0.1"), Ports: []port{{Port: 80}}}))
+		case 1:
+			w.Write([]byte("{garbage"))
+		case 2:
+			writeStatus(w, http.StatusInternalServerError, "InternalError", "try again")
+		case 3:
+			writeEvent(w, "ERROR", endpoints{Message: "expired", Code: http.StatusGone})
+		}
+	})
+
+	counter := &countingTransport{}
+	config := api.config()
+	config.Client = &http.Client{Transport: counter}
+	config.Backoff = &ConstantBackoff{Delay: time.Millisecond}
+	lb := New(config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.watch(ctx, make(chan watchUpdate, 1))
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&cycles) < 40 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	opened, closed := atomic.LoadInt64(&counter.opened), atomic.LoadInt64(&counter.closed)
+	if opened < 40 {
+		t.Fatalf("only %d responses opened", opened)
+	}
+	if opened != closed {
+		t.Fatalf("%d response bodies opened, %d closed", opened, closed)
+	}
+}
+
+func TestResetState(t *testing.T) {
+	lb := newStatic(&Config{}, ep("10.0.0.1", "80"), ep("10.0.0.2", "80"), ep("10.0.0.3", "80"))
+	for i := 0; i < 5; i++ {
+		endpoint, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lb.ReportResult(endpoint, time.Millisecond, errors.New("failed"))
+	}
+	if lb.Cursor() == 0 {
+		t.Fatal("Cursor() = 0 after 5 selections of 3 endpoints")
+	}
+
+	lb.ResetState()
+	if got := lb.Cursor(); got != 0 {
+		t.Errorf("Cursor() = %d after ResetState", got)
+	}
+	for key, n := range lb.SelectionCounts() {
+		if n != 0 {
+			t.Errorf("SelectionCounts()[%s] = %d after ResetState", key, n)
+		}
+	}
+	for _, s := range lb.EndpointStats() {
+		if s.Latency != 0 || s.ErrorRate != 0 || s.ConsecutiveFailures != 0 {
+			t.Errorf("EndpointStats() = %+v after ResetState", s)
+		}
+	}
+	if got, _ := lb.Next(); got.Host != "10.0.0.1" {
+		t.Errorf("Next() = %s after ResetState, want the first endpoint", got.Host)
+	}
+	if len(lb.Endpoints()) != 3 {
+		t.Errorf("ResetState changed the endpoints")
+	}
+}
+
+func TestAutoDetectNamespace(t *testing.T) {
+	defer func(file string) { namespaceFile = file }(namespaceFile)
+	namespaceFile = filepath.Join(t.TempDir(), "namespace")
+	if err := ioutil.WriteFile(namespaceFile, []byte("team-a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{"detected", Config{AutoDetectNamespace: true}, "team-a"},
+		{"explicit", Config{AutoDetectNamespace: true, Namespace: "team-b"}, "team-b"},
+		{"disabled", Config{}, DefaultNamespace},
+	}
+	for _, tt := range tests {
+		if got := New(&tt.config).namespace; got != tt.want {
+			t.Errorf("%s: namespace = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	namespaceFile = filepath.Join(t.TempDir(), "missing")
+	if got := New(&Config{AutoDetectNamespace: true}).namespace; got != DefaultNamespace {
+		t.Errorf("unreadable file: namespace = %q, want %q", got, DefaultNamespace)
+	}
+}
+
+func TestPreferredPortOrder(t *testing.T) {
+	s := subset{
+		Addresses: addresses("10.0.0.1"),
+		Ports: []port{
+			{Name: "metrics", Port: 9090},
+			{Name: "http", Port: 8080},
+			{Name: "grpc", Port: 9000},
+		},
+	}
+	tests := []struct {
+		order []string
+		want  string
+	}{
+		{nil, "9090"},
+		{[]string{"grpc", "http"}, "9000"},
+		{[]string{"admin", "http"}, "8080"},
+		{[]string{"admin"}, "9090"},
+	}
+	for _, tt := range tests {
+		lb := newFromSubsets(&Config{PreferredPortOrder: tt.order}, s)
+		got, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Port != tt.want {
+			t.Errorf("PreferredPortOrder %v: Port = %s, want %s", tt.order, got.Port, tt.want)
+		}
+	}
+}
+
+func TestRequireExplicitPort(t *testing.T) {
+	lb := newFromSubsets(&Config{RequireExplicitPort: true}, subset{
+		Addresses: addresses("10.0.0.1", "10.0.0.2"),
+		Ports:     []port{{Name: "http", Port: 8080}, {Name: "grpc", Port: 9000}},
+	})
+
+	if _, err := lb.Next(); !errors.Is(err, ErrAmbiguousPort) {
+		t.Fatalf("Next() error = %v, want ErrAmbiguousPort", err)
+	}
+	for _, e := range lb.Endpoints() {
+		if e.Port != "" {
+			t.Fatalf("endpoint %s has default Port %q, want none", e.Host, e.Port)
+		}
+	}
+	for _, name := range []string{"http", "grpc"} {
+		got, err := lb.NextForPort(name)
+		if err != nil {
+			t.Fatalf("NextForPort(%q) error = %v", name, err)
+		}
+		if got.Port != got.Ports[name] {
+			t.Fatalf("NextForPort(%q) Port = %s, want %s", name, got.Port, got.Ports[name])
+		}
+	}
+}
+
+func TestLastUpdateSource(t *testing.T) {
+	one := subset{Addresses: addresses("10.0.0.1"), Ports: []port{{Port: 80}}}
+	api := newFakeAPI(t, endpointsObject("1", one))
+	api.setWatch(func(w http.ResponseWriter, r *http.Request) {
+		writeEvent(w, "MODIFIED", endpointsObject("2", one, subset{Addresses: addresses("10.0.0.2"), Ports: []port{{Port: 80}}}))
+		<-r.Context().Done()
+	})
+	lb := New(api.config())
+
+	if source, at := lb.LastUpdateSource(); source != "" || !at.IsZero() {
+		t.Fatalf("LastUpdateSource() = %q, %v before any update", source, at)
+	}
+
+	if err := lb.SyncEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	source, listed := lb.LastUpdateSource()
+	if source != "reconcile" || listed.IsZero() {
+		t.Fatalf("LastUpdateSource() = %q, %v after a list, want reconcile", source, listed)
+	}
+
+	if err := lb.StartBackgroundSync(); err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Shutdown()
+	waitFor(t, "the watch event", func() bool {
+		source, _ := lb.LastUpdateSource()
+		return source == "watch"
+	})
+	if _, watched := lb.LastUpdateSource(); watched.Before(listed) {
+		t.Fatalf("watch update at %v is before the list at %v", watched, listed)
+	}
+	if n := len(lb.Endpoints()); n != 2 {
+		t.Fatalf("len(Endpoints()) = %d after the watch event, want 2", n)
+	}
+}
+
+func TestChurnKeepsStateBounded(t *testing.T) {
+	clock := newFakeClock()
+	lb := New(&Config{
+		MinStableDuration: time.Second,
+		HealthCheck: &HealthCheck{
+			Check: func(e Endpoint) bool { return !strings.HasSuffix(e.Host, ".1") },
+		},
+		WeightFunc: func(e Endpoint) int {
+			if strings.HasSuffix(e.Host, ".2") {
+				return 2
+			}
+			return 1
+		},
+	})
+	lb.now = clock.Now
+
+	const batch = 10
+	var release func()
+	for round := 0; round < 1000/batch; round++ {
+		eps := make([]Endpoint, batch)
+		for i := range eps {
+			eps[i] = ep(fmt.Sprintf("10.%d.%d.%d", round/256, round%256, i), "80")
+		}
+		lb.Prime(eps)
+		clock.Advance(2 * time.Second)
+		lb.probeEndpoints()
+		for i := 0; i < batch; i++ {
+			if _, err := lb.Next(); err != nil {
+				t.Fatalf("round %d: %v", round, err)
+			}
+		}
+		if round == 0 {
+			var err error
+			if _, release, err = lb.Acquire(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	lb.mu.RLock()
+	sizes := map[string]int{
+		"unhealthy":      len(lb.unhealthy),
+		"firstSeen":      len(lb.firstSeen),
+		"currentWeights": len(lb.currentWeights),
+		"endpointStats":  len(lb.endpointStats),
+	}
+	leases := len(lb.leases)
+	lb.mu.RUnlock()
+	for name, n := range sizes {
+		if n > batch {
+			t.Errorf("len(%s) = %d after churn, want at most the %d live endpoints", name, n, batch)
+		}
+	}
+	// The lease taken in the first round drains until it is released.
+	if leases != 1 {
+		t.Errorf("len(leases) = %d, want the 1 draining lease", leases)
+	}
+	release()
+	lb.mu.RLock()
+	leases = len(lb.leases)
+	lb.mu.RUnlock()
+	if leases != 0 {
+		t.Errorf("len(leases) = %d after release, want 0", leases)
+	}
+}
+
+func TestOnRequest(t *testing.T) {
+	api := newFakeAPI(t, endpointsObject("7", subset{Addresses: addresses("10.0.0.1"), Ports: []port{{Port: 80}}}))
+	var mu sync.Mutex
+	var requests []string
+	config := api.config()
+	config.BearerToken = "secret"
+	config.OnRequest = func(method, url string) {
+		mu.Lock()
+		requests = append(requests, method+" "+url)
+		mu.Unlock()
+	}
+	lb := New(config)
+
+	if err := lb.SyncEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.StartBackgroundSync(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the watch request", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(requests) >= 2
+	})
+	lb.Shutdown()
+
+	want := []string{
+		"GET " + api.URL + "/api/v1/namespaces/default/endpoints/test",
+		"GET " + api.URL + "/api/v1/watch/namespaces/default/endpoints/test?resourceVersion=7",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i, w := range want {
+		if requests[i] != w {
+			t.Errorf("request %d = %q, want %q", i, requests[i], w)
+		}
+	}
+	for _, r := range requests {
+		if strings.Contains(r, "secret") {
+			t.Errorf("request %q reports the bearer token", r)
+		}
+	}
+}
+
+func TestMinStableDuration(t *testing.T) {
+	clock := newFakeClock()
+	lb := New(&Config{MinStableDuration: 10 * time.Second})
+	lb.now = clock.Now
+	old := ep("10.0.0.1", "80")
+	lb.Prime([]Endpoint{old})
+	clock.Advance(10 * time.Second)
+
+	lb.Prime([]Endpoint{old, ep("10.0.0.2", "80")})
+	if n := len(lb.Endpoints()); n != 2 {
+		t.Fatalf("len(Endpoints()) = %d, want the new endpoint listed at once", n)
+	}
+	for _, elapsed := range []time.Duration{0, 5 * time.Second, 4 * time.Second} {
+		clock.Advance(elapsed)
+		for i := 0; i < 4; i++ {
+			if got, err := lb.Next(); err != nil || got.Host != "10.0.0.1" {
+				t.Fatalf("Next() = %s, %v while 10.0.0.2 is settling", got.Host, err)
+			}
+		}
+	}
+
+	clock.Advance(time.Second)
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		got, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[got.Host] = true
+	}
+	if !seen["10.0.0.2"] {
+		t.Fatal("Next() never returned 10.0.0.2 after MinStableDuration")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	clock := newFakeClock()
+	api := newFakeAPI(t, endpointsObject("1"))
+	tooMany := func(retryAfter string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", retryAfter)
+			writeStatus(w, http.StatusTooManyRequests, "TooManyRequests", "slow down")
+		}
+	}
+	config := api.config()
+	config.Backoff = &ConstantBackoff{Delay: time.Millisecond}
+	lb := New(config)
+	lb.now = clock.Now
+
+	for _, retryAfter := range []string{"10", clock.Now().Add(10 * time.Second).Format(http.TimeFormat)} {
+		api.setList(tooMany(retryAfter))
+		err := lb.SyncEndpoints()
+		var e *SyncError
+		if !errors.As(err, &e) || e.Code != http.StatusTooManyRequests {
+			t.Fatalf("Retry-After %s: SyncEndpoints() error = %v, want a 429 SyncError", retryAfter, err)
+		}
+		if e.RetryAfter != 10*time.Second {
+			t.Fatalf("Retry-After %s: RetryAfter = %v, want 10s", retryAfter, e.RetryAfter)
+		}
+		if d := lb.retryDelay(1, e); d != 10*time.Second {
+			t.Fatalf("Retry-After %s: retryDelay() = %v, want 10s over the 1ms backoff", retryAfter, d)
+		}
+	}
+
+	// The watch waits out the Retry-After before reconnecting.
+	var watches int64
+	api.setWatch(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&watches, 1)
+		tooMany("10")(w, r)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.watch(ctx, make(chan watchUpdate, 1))
+	}()
+	waitFor(t, "the watch request", func() bool { return atomic.LoadInt64(&watches) > 0 })
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+	if n := atomic.LoadInt64(&watches); n != 1 {
+		t.Fatalf("watch reconnected %d times during its Retry-After", n-1)
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	const object = `{"kind":"Endpoints","apiVersion":"v1","metadata":{"name":"test","resourceVersion":"1"},` +
+		`"subsets":[{"addresses":[{"ip":"10.0.0.1","extraField":true}],"ports":[{"port":80}]}]}`
+	api := newFakeAPI(t, endpoints{})
+	api.setList(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, object)
+	})
+	event := `{"type":"MODIFIED","object":` + object + "}\n"
+
+	for _, strict := range []bool{false, true} {
+		config := api.config()
+		config.StrictJSON = strict
+		lb := New(config)
+
+		err := lb.SyncEndpoints()
+		if strict && (err == nil || !strings.Contains(err.Error(), "extraField")) {
+			t.Fatalf("strict: SyncEndpoints() error = %v, want the unknown field reported", err)
+		}
+		if !strict && (err != nil || len(lb.Endpoints()) != 1) {
+			t.Fatalf("lenient: SyncEndpoints() error = %v, Endpoints() = %v", err, lb.Endpoints())
+		}
+
+		pending := make(chan watchUpdate, 1)
+		lb.watchStream(context.Background(), "/watch", ioutil.NopCloser(strings.NewReader(event)), pending)
+		if queued := len(pending) == 1; queued == strict {
+			t.Fatalf("strict=%v: watch event queued = %v, want %v", strict, queued, !strict)
+		}
+	}
+}
+
+func TestWatchFloodAppliesLatest(t *testing.T) {
+	const events = 500
+	api := newFakeAPI(t, endpointsObject("0"))
+	var sent int64
+	api.setWatch(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt64(&sent) == 0 {
+			for i := 1; i <= events; i++ {
+				writeEvent(w, "MODIFIED", endpointsObject(fmt.Sprint(i), subset{
+					Addresses: addresses(fmt.Sprintf("10.%d.%d.1", i/256, i%256), "10.255.0.1"),
+					Ports:     []port{{Port: 80}},
+				}))
+				atomic.StoreInt64(&sent, int64(i))
+			}
+		}
+		<-r.Context().Done()
+	})
+
+	// A slow AddressFilter makes applying fall far behind the watch.
+	var applied int64
+	config := api.config()
+	config.AddressFilter = func(a Address) bool {
+		if a.IP == "10.255.0.1" {
+			atomic.AddInt64(&applied, 1)
+			time.Sleep(time.Millisecond)
+		}
+		return true
+	}
+	lb := New(config)
+	if err := lb.StartBackgroundSync(); err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Shutdown()
+
+	want := fmt.Sprintf("10.%d.%d.1", events/256, events%256)
+	waitFor(t, "the last event", func() bool {
+		eps := lb.Endpoints()
+		return len(eps) == 2 && (eps[0].Host == want || eps[1].Host == want)
+	})
+	if n := atomic.LoadInt64(&sent); n != events {
+		t.Fatalf("applied the last event after only %d were sent", n)
+	}
+	if n := atomic.LoadInt64(&applied); n >= events {
+		t.Fatalf("applied %d of %d events, want intermediate states dropped", n, events)
+	}
+}
+
+func TestShutdownStopsGoroutines(t *testing.T) {
+	api := newFakeAPI(t, endpointsObject("1", subset{
+		Addresses: []address{{IP: "10.0.0.1"}, {Hostname: "db.example.com"}},
+		Ports:     []port{{Port: 80}},
+	}))
+	resolver := &stubResolver{hosts: map[string][]string{"db.example.com": {"10.0.1.1"}}}
+	config := api.config()
+	config.Resolver = resolver
+	config.HealthCheck = &HealthCheck{Check: func(Endpoint) bool { return true }, Interval: time.Millisecond}
+	lb := New(config)
+	if n := lb.ActiveGoroutines(); n != 0 {
+		t.Fatalf("ActiveGoroutines() = %d before starting, want 0", n)
+	}
+
+	if err := lb.SyncEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.StartBackgroundSync(); err != nil {
+		t.Fatal(err)
+	}
+	// The watch, its applier, the reconcile loop and the health check
+	// loop run until Shutdown.
+	waitFor(t, "the background goroutines", func() bool { return lb.ActiveGoroutines() >= 4 })
+	waitFor(t, "the hostname to resolve", func() bool { return len(lb.Endpoints()) == 2 })
+
+	lb.Shutdown()
+	waitFor(t, "the goroutines to stop", func() bool { return lb.ActiveGoroutines() == 0 })
+}
+
+func TestOnWatchSynced(t *testing.T) {
+	one := subset{Addresses: addresses("10.0.0.1"), Ports: []port{{Port: 80}}}
+	two := subset{Addresses: addresses("10.0.0.1", "10.0.0.2"), Ports: []port{{Port: 80}}}
+	api := newFakeAPI(t, endpointsObject("1"))
+	api.setWatch(func(w http.ResponseWriter, r *http.Request) {
+		writeEvent(w, "ADDED", endpointsObject("2", one))
+		writeEvent(w, "MODIFIED", endpointsObject("3", two))
+		<-r.Context().Done()
+	})
+	var synced int64
+	config := api.config()
+	config.OnWatchSynced = func() { atomic.AddInt64(&synced, 1) }
+	lb := New(config)
+	if err := lb.StartBackgroundSync(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the watch events", func() bool { return len(lb.Endpoints()) == 2 })
+	lb.Shutdown()
+	if n := atomic.LoadInt64(&synced); n != 1 {
+		t.Fatalf("OnWatchSynced called %d times, want 1", n)
+	}
+}
+
+func TestSubsetSelector(t *testing.T) {
+	subsets := []subset{
+		{Addresses: addresses("10.0.0.1"), Ports: []port{{Name: "http", Port: 8080}}},
+		{Addresses: addresses("10.0.1.1", "10.0.1.2"), Ports: []port{{Name: "http", Port: 8080}, {Name: "grpc", Port: 9000}}},
+		{Addresses: addresses("10.0.2.1"), Ports: []port{{Name: "grpc", Port: 9000}}},
+	}
+	var indexes []int
+	selector := func(i int, ports []PortInfo) bool {
+		indexes = append(indexes, i)
+		names := make(map[string]bool)
+		for _, p := range ports {
+			names[p.Name] = true
+		}
+		return len(ports) == 2 && names["http"] && names["grpc"]
+	}
+	lb := newFromSubsets(&Config{SubsetSelector: selector}, subsets...)
+
+	if got, want := fmt.Sprint(indexes), "[0 1 2]"; got != want {
+		t.Fatalf("SubsetSelector called with indexes %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(joinedHostPorts(lb.Endpoints())), "[10.0.1.1:8080 10.0.1.2:8080]"; got != want {
+		t.Fatalf("Endpoints() = %s, want only the addresses of the selected subset %s", got, want)
+	}
+}
+
+func TestMaxWatchReconnects(t *testing.T) {
+	api := newFakeAPI(t, endpointsObject("1"))
+	var watches int64
+	api.setWatch(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&watches, 1)
+		writeStatus(w, http.StatusInternalServerError, "InternalError", "broken")
+	})
+	var gaveUp []error
+	config := api.config()
+	config.Backoff = &ConstantBackoff{Delay: time.Millisecond}
+	config.MaxWatchReconnects = 3
+	config.OnWatchGaveUp = func(err error) { gaveUp = append(gaveUp, err) }
+	lb := New(config)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.watch(context.Background(), make(chan watchUpdate, 1))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not give up")
+	}
+
+	if n := atomic.LoadInt64(&watches); n != 3 {
+		t.Fatalf("watch made %d attempts, want 3", n)
+	}
+	var e *SyncError
+	if len(gaveUp) != 1 || !errors.As(gaveUp[0], &e) || e.Code != http.StatusInternalServerError {
+		t.Fatalf("OnWatchGaveUp called with %v, want the last error once", gaveUp)
+	}
+}
+
+func TestFormatCachedByResourceVersion(t *testing.T) {
+	// The AddressFilter runs once per address every time an object is
+	// formatted, so it counts the calls of formatEndpoints.
+	var formatted int
+	lb := New(&Config{AddressFilter: func(Address) bool {
+		formatted++
+		return true
+	}})
+	object := func(version string) endpoints {
+		return endpointsObject(version, subset{Addresses: addresses("10.0.0.1"), Ports: []port{{Port: 80}}})
+	}
+
+	lb.apply(object("1"), sourceWatch)
+	lb.apply(object("1"), sourceWatch)
+	lb.apply(object("1"), sourceReconcile)
+	if formatted != 1 {
+		t.Fatalf("formatted %d times for a redelivered resourceVersion, want 1", formatted)
+	}
+	if n := len(lb.Endpoints()); n != 1 {
+		t.Fatalf("len(Endpoints()) = %d, want 1", n)
+	}
+
+	lb.apply(object("2"), sourceWatch)
+	if formatted != 2 {
+		t.Fatalf("formatted %d times after a new resourceVersion, want 2", formatted)
+	}
+	lb.apply(object("1"), sourceWatch)
+	if formatted != 2 {
+		t.Fatalf("formatted %d times for a cached older resourceVersion, want 2", formatted)
+	}
+
+	// Only the last few versions are kept.
+	for v := 3; v < 3+formatCacheSize; v++ {
+		lb.apply(object(fmt.Sprint(v)), sourceWatch)
+	}
+	formatted = 0
+	lb.apply(object("1"), sourceWatch)
+	if formatted != 1 || len(lb.formatted) != formatCacheSize {
+		t.Fatalf("formatted %d times for an evicted resourceVersion with %d cached, want 1 with %d",
+			formatted, len(lb.formatted), formatCacheSize)
+	}
+}
+
+func TestAcceptHeader(t *testing.T) {
+	for _, accept := range []string{"", "application/vnd.kubernetes.protobuf, application/json"} {
+		api := newFakeAPI(t, endpointsObject("1"))
+		headers := make(chan string, 2)
+		list, watch := api.list, api.watch
+		api.setList(func(w http.ResponseWriter, r *http.Request) {
+			headers <- "list " + r.Header.Get("Accept")
+			list(w, r)
+		})
+		api.setWatch(func(w http.ResponseWriter, r *http.Request) {
+			headers <- "watch " + r.Header.Get("Accept")
+			watch(w, r)
+		})
+		config := api.config()
+		config.Accept = accept
+		lb := New(config)
+		if err := lb.SyncEndpoints(); err != nil {
+			t.Fatal(err)
+		}
+		if err := lb.StartBackgroundSync(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := accept
+		if want == "" {
+			want = DefaultAccept
+		}
+		for _, kind := range []string{"list", "watch"} {
+			select {
+			case got := <-headers:
+				if got != kind+" "+want {
+					t.Errorf("%s request sent Accept %q, want %q", kind, got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %s request", kind)
+			}
+		}
+		lb.Shutdown()
+	}
+}
+
+func TestServiceExists(t *testing.T) {
+	api := newFakeAPI(t, endpointsObject("1"))
+	lb := New(api.config())
+	if lb.ServiceExists() {
+		t.Fatal("ServiceExists() = true before the first sync")
+	}
+
+	if err := lb.SyncEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	if !lb.ServiceExists() || len(lb.Endpoints()) != 0 {
+		t.Fatalf("ServiceExists() = %v with %d endpoints, want true for an object without subsets",
+			lb.ServiceExists(), len(lb.Endpoints()))
+	}
+
+	api.setList(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusNotFound, "NotFound", `endpoints "test" not found`)
+	})
+	if err := lb.SyncEndpoints(); err == nil {
+		t.Fatal("SyncEndpoints() succeeded for a missing service")
+	}
+	if lb.ServiceExists() {
+		t.Fatal("ServiceExists() = true after a 404")
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	a, b := ep("10.0.0.1", "80"), ep("10.0.0.2", "80")
+	failed := errors.New("failed")
+	for _, failOpen := range []bool{false, true} {
+		lb := newStatic(&Config{
+			FailOpen:    failOpen,
+			HealthCheck: &HealthCheck{Check: func(Endpoint) bool { return false }},
+		}, a, b)
+		lb.ReportResult(a, time.Millisecond, failed)
+		lb.ReportResult(a, time.Millisecond, failed)
+		lb.ReportResult(b, time.Millisecond, failed)
+		lb.probeEndpoints()
+
+		got, err := lb.Next()
+		if !failOpen {
+			if err != ErrNoEndpoints {
+				t.Fatalf("fail-closed: Next() = %s, %v with every endpoint ejected, want ErrNoEndpoints", got.Host, err)
+			}
+			continue
+		}
+		if err != nil || got.Host != b.Host {
+			t.Fatalf("fail-open: Next() = %s, %v, want the least bad endpoint %s", got.Host, err, b.Host)
+		}
+	}
+}
+
+func TestRetryableError(t *testing.T) {
+	for _, custom := range []bool{false, true} {
+		api := newFakeAPI(t, endpointsObject("1"))
+		var watches int64
+		api.setWatch(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&watches, 1)
+			writeStatus(w, http.StatusTeapot, "Teapot", "short and stout")
+		})
+		config := api.config()
+		config.Backoff = &ConstantBackoff{Delay: time.Millisecond}
+		if custom {
+			config.RetryableError = func(err error, statusCode int) bool {
+				return statusCode == http.StatusTeapot || retryable(err, statusCode)
+			}
+		}
+		lb := New(config)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			lb.watch(ctx, make(chan watchUpdate, 1))
+		}()
+		if custom {
+			waitFor(t, "the watch to retry", func() bool { return atomic.LoadInt64(&watches) >= 3 })
+		} else {
+			waitFor(t, "the watch request", func() bool { return atomic.LoadInt64(&watches) > 0 })
+			time.Sleep(100 * time.Millisecond)
+		}
+		cancel()
+		<-done
+
+		if n := atomic.LoadInt64(&watches); !custom && n != 1 {
+			t.Fatalf("watch retried a 418 %d times by default, want it to wait for the next sync", n-1)
+		}
+	}
+}
+
+func TestSetCursor(t *testing.T) {
+	lb := newStatic(&Config{}, ep("10.0.0.1", "80"), ep("10.0.0.2", "80"), ep("10.0.0.3", "80"))
+	tests := []struct {
+		set, cursor int
+		host        string
+	}{
+		{0, 0, "10.0.0.1"},
+		{2, 2, "10.0.0.3"},
+		{4, 1, "10.0.0.2"},
+		{-1, 2, "10.0.0.3"},
+	}
+	for _, tt := range tests {
+		lb.SetCursor(tt.set)
+		if got := lb.Cursor(); got != tt.cursor {
+			t.Fatalf("Cursor() = %d after SetCursor(%d), want %d", got, tt.set, tt.cursor)
+		}
+		got, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Host != tt.host {
+			t.Fatalf("Next() = %s after SetCursor(%d), want %s", got.Host, tt.set, tt.host)
+		}
+		if want := (tt.cursor + 1) % 3; lb.Cursor() != want {
+			t.Fatalf("Cursor() = %d after Next, want %d", lb.Cursor(), want)
+		}
+	}
+
+	empty := New(&Config{})
+	empty.SetCursor(5)
+	if got := empty.Cursor(); got != 0 {
+		t.Fatalf("Cursor() = %d without endpoints, want 0", got)
+	}
+}
+
+func TestOnSyncComplete(t *testing.T) {
+	api := newFakeAPI(t, endpointsObject("1", subset{Addresses: addresses("10.0.0.1"), Ports: []port{{Port: 80}}}))
+	type result struct {
+		code     int
+		duration time.Duration
+		err      error
+	}
+	var syncs []result
+	config := api.config()
+	config.OnSyncComplete = func(code int, duration time.Duration, err error) {
+		syncs = append(syncs, result{code, duration, err})
+	}
+	lb := New(config)
+
+	if err := lb.SyncEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	api.setList(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusForbidden, "Forbidden", "no access")
+	})
+	if err := lb.SyncEndpoints(); err == nil {
+		t.Fatal("SyncEndpoints() succeeded on a 403")
+	}
+
+	if len(syncs) != 2 {
+		t.Fatalf("OnSyncComplete called %d times, want 2", len(syncs))
+	}
+	if s := syncs[0]; s.code != http.StatusOK || s.duration <= 0 || s.err != nil {
+		t.Fatalf("successful sync reported %d, %v, %v, want 200 with a positive duration", s.code, s.duration, s.err)
+	}
+	if s := syncs[1]; s.code != http.StatusForbidden || s.err == nil {
+		t.Fatalf("failed sync reported %d, %v, want 403 with its error", s.code, s.err)
+	}
+}
+
+func TestFormatEverySubset(t *testing.T) {
+	lb := newFromSubsets(&Config{},
+		subset{Addresses: addresses("10.0.0.1", "10.0.0.2"), Ports: []port{{Name: "http", Port: 8080}}},
+		subset{Addresses: addresses("10.0.1.1"), Ports: []port{{Name: "grpc", Port: 9000}, {Name: "metrics", Port: 9090}}},
+	)
+	want := map[string]struct {
+		port  string
+		ports map[string]string
+	}{
+		"10.0.0.1": {"8080", map[string]string{"http": "8080"}},
+		"10.0.0.2": {"8080", map[string]string{"http": "8080"}},
+		"10.0.1.1": {"9000", map[string]string{"grpc": "9000", "metrics": "9090"}},
+	}
+	eps := lb.Endpoints()
+	if len(eps) != len(want) {
+		t.Fatalf("Endpoints() = %v, want an endpoint for every address of both subsets", eps)
+	}
+	for _, e := range eps {
+		w, ok := want[e.Host]
+		if !ok {
+			t.Fatalf("unexpected endpoint %s", e.Host)
+		}
+		if e.Port != w.port || !reflect.DeepEqual(e.Ports, w.ports) {
+			t.Errorf("endpoint %s has Port %s and Ports %v, want %s and %v", e.Host, e.Port, e.Ports, w.port, w.ports)
+		}
+	}
+}
+
+func TestParseErrorKeepsEndpoints(t *testing.T) {
+	api := newFakeAPI(t, endpointsObject("1", subset{Addresses: addresses("10.0.0.1", "10.0.0.2"), Ports: []port{{Port: 80}}}))
+	var watches int64
+	api.setWatch(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&watches, 1) == 1 {
+			io.WriteString(w, `{"type":"MODIFIED","object":{"subsets":[{"addresses":garbled}]}}`+"\n")
+			return
+		}
+		<-r.Context().Done()
+	})
+	lb := New(api.config())
+	if err := lb.SyncEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprint(joinedHostPorts(lb.Endpoints()))
+
+	if err := lb.StartBackgroundSync(); err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Shutdown()
+	waitFor(t, "the parse error", func() bool { return lb.Stats().ParseError != nil })
+	if got := fmt.Sprint(joinedHostPorts(lb.Endpoints())); got != want {
+		t.Fatalf("Endpoints() = %s after a garbled watch event, want %s", got, want)
+	}
+
+	api.setList(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"kind":"Endpoints","subsets":[{"addresses":[`)
+	})
+	if err := lb.SyncEndpoints(); err == nil {
+		t.Fatal("SyncEndpoints() succeeded on a truncated response")
+	}
+	if got := fmt.Sprint(joinedHostPorts(lb.Endpoints())); got != want {
+		t.Fatalf("Endpoints() = %s after a truncated list response, want %s", got, want)
+	}
+	if lb.Stats().ParseError == nil {
+		t.Fatal("Stats().ParseError = nil after a truncated list response")
+	}
+}
+
+func TestSyncErrorReason(t *testing.T) {
+	api := newFakeAPI(t, endpointsObject("1"))
+	api.setList(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusForbidden, "Forbidden", `endpoints "test" is forbidden`)
+	})
+	err := New(api.config()).SyncEndpoints()
+	var e *SyncError
+	if !errors.As(err, &e) {
+		t.Fatalf("SyncEndpoints() error = %v, want a *SyncError", err)
+	}
+	if e.Reason != "Forbidden" || e.Code != http.StatusForbidden || e.Message != `endpoints "test" is forbidden` {
+		t.Fatalf("SyncError Reason, Code, Message = %q, %d, %q", e.Reason, e.Code, e.Message)
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	api := newFakeAPI(t, endpointsObject("1"))
+	lb := New(api.config())
+	if err := lb.StartBackgroundSync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.Shutdown(); err != nil {
+		t.Fatalf("first Shutdown() = %v", err)
+	}
+	if err := lb.Shutdown(); err != nil {
+		t.Fatalf("second Shutdown() = %v, want nil", err)
+	}
+
+	// Shutting down a LoadBalancer that never started is also fine.
+	idle := New(&Config{})
+	idle.Shutdown()
+	idle.Shutdown()
+}
+
+func TestIncludeNotReady(t *testing.T) {
+	s := subset{
+		Addresses:         addresses("10.0.0.1"),
+		NotReadyAddresses: addresses("10.0.0.2", "10.0.0.3"),
+		Ports:             []port{{Port: 80}},
+	}
+	tests := []struct {
+		include bool
+		want    map[string]bool // hosts and whether they are ready
+	}{
+		{false, map[string]bool{"10.0.0.1": true}},
+		{true, map[string]bool{"10.0.0.1": true, "10.0.0.2": false, "10.0.0.3": false}},
+	}
+	for _, tt := range tests {
+		lb := newFromSubsets(&Config{IncludeNotReady: tt.include}, s)
+		got := make(map[string]bool)
+		for _, e := range lb.Endpoints() {
+			got[e.Host] = e.Ready
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("IncludeNotReady %v: endpoints and readiness = %v, want %v", tt.include, got, tt.want)
+		}
+	}
+}
+
+func TestNextAcrossResizes(t *testing.T) {
+	lb := New(&Config{})
+	sizes := []int{5, 2, 7, 1, 3}
+	for round, n := range sizes {
+		eps := make([]Endpoint, n)
+		for i := range eps {
+			eps[i] = ep(fmt.Sprintf("10.0.0.%d", i+1), "80")
+		}
+		lb.Prime(eps)
+		if c := lb.Cursor(); c < 0 || c >= n {
+			t.Fatalf("round %d: Cursor() = %d with %d endpoints", round, c, n)
+		}
+		// Leave the cursor past the end of the next, smaller, list.
+		for i := 0; i < n-1; i++ {
+			if _, err := lb.Next(); err != nil {
+				t.Fatalf("round %d: %v", round, err)
+			}
+		}
+		seen := make(map[string]bool)
+		for i := 0; i < n; i++ {
+			got, err := lb.Next()
+			if err != nil {
+				t.Fatalf("round %d: %v", round, err)
+			}
+			seen[got.Host] = true
+		}
+		if len(seen) != n {
+			t.Fatalf("round %d: %d calls returned %d distinct endpoints, want each of the %d", round, n, len(seen), n)
+		}
+	}
+}
+
+func TestEndpointsOrderIsStable(t *testing.T) {
+	first := endpointsObject("1",
+		subset{Addresses: addresses("10.0.0.9", "10.0.0.10", "10.0.0.2"), Ports: []port{{Port: 9000}}},
+		subset{Addresses: addresses("10.0.0.2"), Ports: []port{{Port: 443}}},
+	)
+	reordered := endpointsObject("2",
+		subset{Addresses: addresses("10.0.0.2"), Ports: []port{{Port: 443}}},
+		subset{Addresses: addresses("10.0.0.2", "10.0.0.10", "10.0.0.9"), Ports: []port{{Port: 9000}}},
+	)
+	api := newFakeAPI(t, first)
+	lb := New(api.config())
+	if err := lb.SyncEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	before := lb.Endpoints()
+	next, err := lb.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api.setList(func(w http.ResponseWriter, r *http.Request) { writeJSON(w, reordered) })
+	if err := lb.SyncEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	after := lb.Endpoints()
+	if !reflect.DeepEqual(before, after) {
+		t.Fatalf("Endpoints() changed after a reordered sync:\n%v\n%v", before, after)
+	}
+	var order []string
+	for _, e := range after {
+		order = append(order, e.Host+":"+e.Port)
+	}
+	if got, want := strings.Join(order, " "), "10.0.0.10:9000 10.0.0.2:443 10.0.0.2:9000 10.0.0.9:9000"; got != want {
+		t.Fatalf("Endpoints() order = %s, want %s", got, want)
+	}
+	// The resync does not scramble which endpoint comes next.
+	if got, err := lb.Next(); err != nil || got.Host+":"+got.Port != order[1] {
+		t.Fatalf("Next() after %s:%s = %s:%s, %v, want %s", next.Host, next.Port, got.Host, got.Port, err, order[1])
+	}
+}
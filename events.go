@@ -0,0 +1,122 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// eventBufferSize is the capacity of the channel returned by Events.
+const eventBufferSize = 100
+
+// EventKind identifies what an Event reports.
+type EventKind string
+
+const (
+	// SyncSucceeded reports a successful list of the service endpoints.
+	SyncSucceeded EventKind = "SyncSucceeded"
+
+	// SyncFailed reports a failed list of the service endpoints.
+	SyncFailed EventKind = "SyncFailed"
+
+	// WatchReconnected reports that the endpoints watch was re-established
+	// after the previous watch ended.
+	WatchReconnected EventKind = "WatchReconnected"
+
+	// EndpointAdded, EndpointRemoved and EndpointModified report a change
+	// of a single endpoint, identified by its Host and Port, when the set
+	// of endpoints is updated. Endpoint holds the added or modified
+	// endpoint, or the endpoint as it was before it was removed.
+	EndpointAdded    EventKind = "EndpointAdded"
+	EndpointRemoved  EventKind = "EndpointRemoved"
+	EndpointModified EventKind = "EndpointModified"
+
+	// EndpointEjected reports that an endpoint failed its health probe and
+	// is skipped by selection, and EndpointRecovered that an ejected
+	// endpoint passed a later probe.
+	EndpointEjected   EventKind = "EndpointEjected"
+	EndpointRecovered EventKind = "EndpointRecovered"
+)
+
+// An Event is a diagnostic notification emitted by a LoadBalancer.
+type Event struct {
+	Kind     EventKind
+	Message  string
+	Endpoint Endpoint // set for events concerning a single endpoint
+	At       time.Time
+}
+
+// Events returns a channel that receives diagnostic events, including an
+// event for every endpoint added, removed or modified by an update. Events
+// are sent without blocking; when the channel buffer is full new events are
+// dropped and counted by DroppedEvents. A consumer that must not miss a
+// change should compare Endpoints against its own state when
+// DroppedEvents grows. The channel is closed by Shutdown.
+func (lb *LoadBalancer) Events() <-chan Event {
+	return lb.events
+}
+
+// DroppedEvents returns the number of events dropped because the channel
+// returned by Events was full.
+func (lb *LoadBalancer) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&lb.droppedEvents)
+}
+
+func (lb *LoadBalancer) emit(kind EventKind, message string, endpoint Endpoint) {
+	lb.eventsMu.Lock()
+	defer lb.eventsMu.Unlock()
+	if lb.eventsClosed {
+		return
+	}
+
+	e := Event{
+		Kind:     kind,
+		Message:  message,
+		Endpoint: endpoint,
+		At:       lb.now(),
+	}
+	select {
+	case lb.events <- e:
+	default:
+		atomic.AddUint64(&lb.droppedEvents, 1)
+	}
+}
+
+// emitChanges emits an event for every endpoint added, removed or modified
+// between old and endpoints.
+func (lb *LoadBalancer) emitChanges(old, endpoints []Endpoint) {
+	byKey := make(map[string]Endpoint, len(old))
+	for _, ep := range old {
+		byKey[ep.key()] = ep
+	}
+	for _, ep := range endpoints {
+		key := ep.key()
+		prev, ok := byKey[key]
+		switch {
+		case !ok:
+			lb.emit(EndpointAdded, "", ep)
+		case !equalEndpoint(prev, ep):
+			lb.emit(EndpointModified, "", ep)
+		}
+		delete(byKey, key)
+	}
+	for _, ep := range old {
+		key := ep.key()
+		if _, ok := byKey[key]; ok {
+			lb.emit(EndpointRemoved, "", ep)
+			delete(byKey, key)
+		}
+	}
+}
+
+func (lb *LoadBalancer) closeEvents() {
+	lb.eventsMu.Lock()
+	if !lb.eventsClosed {
+		lb.eventsClosed = true
+		close(lb.events)
+	}
+	lb.eventsMu.Unlock()
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// drainEvents returns the events buffered in the channel returned by
+// Events.
+func drainEvents(lb *LoadBalancer) []Event {
+	var events []Event
+	for {
+		select {
+		case e := <-lb.Events():
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+// eventsOf returns the hosts of the endpoints of the events of the given
+// kind.
+func eventsOf(events []Event, kind EventKind) []string {
+	var hosts []string
+	for _, e := range events {
+		if e.Kind == kind {
+			hosts = append(hosts, e.Endpoint.Host)
+		}
+	}
+	return hosts
+}
+
+func TestSyncEvents(t *testing.T) {
+	api := newFakeAPI(t, endpointsObject("1", subset{Addresses: addresses("10.0.0.1"), Ports: []port{{Port: 80}}}))
+	lb := New(api.config())
+
+	if err := lb.SyncEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	events := drainEvents(lb)
+	if len(eventsOf(events, SyncSucceeded)) != 1 {
+		t.Fatalf("events after a good sync = %v, want one SyncSucceeded", events)
+	}
+	if got := eventsOf(events, EndpointAdded); len(got) != 1 || got[0] != "10.0.0.1" {
+		t.Fatalf("EndpointAdded events = %v, want [10.0.0.1]", got)
+	}
+
+	api.setList(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusInternalServerError, "InternalError", "etcd unavailable")
+	})
+	if err := lb.SyncEndpoints(); err == nil {
+		t.Fatal("SyncEndpoints() succeeded against a failing API server")
+	}
+	events = drainEvents(lb)
+	if len(events) != 1 || events[0].Kind != SyncFailed {
+		t.Fatalf("events after a bad sync = %v, want one SyncFailed", events)
+	}
+	if !strings.Contains(events[0].Message, "etcd unavailable") || events[0].At.IsZero() {
+		t.Fatalf("SyncFailed event = %+v, want the error message and time", events[0])
+	}
+}
+
+func TestEventsDroppedAndClosed(t *testing.T) {
+	lb := New(&Config{})
+	for i := 0; i < eventBufferSize+5; i++ {
+		lb.emit(SyncSucceeded, "", Endpoint{})
+	}
+	if got := lb.DroppedEvents(); got != 5 {
+		t.Fatalf("DroppedEvents() = %d, want 5", got)
+	}
+
+	lb.Shutdown()
+	n := 0
+	for range lb.Events() {
+		n++
+	}
+	if n != eventBufferSize {
+		t.Fatalf("received %d events before the channel closed, want %d", n, eventBufferSize)
+	}
+	lb.emit(SyncSucceeded, "", Endpoint{}) // must not panic after Shutdown
+}
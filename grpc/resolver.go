@@ -0,0 +1,163 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+// Package grpc resolves Kubernetes services for gRPC clients using an
+// endpoints.LoadBalancer, so that connections follow endpoint changes as
+// they happen instead of relying on DNS. It lives in its own package so
+// that users of the endpoints package who do not use gRPC do not depend on
+// it. Imported as epgrpc:
+//
+//	resolver.Register(epgrpc.NewBuilder("kubernetes", &endpoints.Config{}))
+//	conn, err := grpc.Dial("kubernetes://default/nginx:grpc", ...)
+//
+// Load balancing between the addresses is left to the gRPC balancing
+// policy of the connection, such as round_robin.
+package grpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/endpoints"
+	"google.golang.org/grpc/resolver"
+)
+
+// ErrMissingService is returned by Build when the target does not name a
+// service.
+var ErrMissingService = errors.New("endpoints/grpc: missing service name")
+
+// NewBuilder returns a resolver.Builder for targets of the form
+// "scheme://namespace/service" or "scheme://namespace/service:port", where
+// port names the port to connect to. If the namespace is empty,
+// config.Namespace is used, and if no port is named, the Port of each
+// endpoint is used.
+//
+// Each resolver built creates a LoadBalancer from a copy of config with the
+// namespace and service of its target, and starts background
+// synchronization. Callbacks in config are shared by all of them. The
+// endpoints are listed as soon as the resolver is built and the state is
+// pushed to the ClientConn once they are, even if the service has none.
+// Failed list requests are reported through ClientConn.ReportError.
+func NewBuilder(scheme string, config *endpoints.Config) resolver.Builder {
+	return &builder{scheme: scheme, config: *config}
+}
+
+type builder struct {
+	scheme string
+	config endpoints.Config
+}
+
+func (b *builder) Scheme() string {
+	return b.scheme
+}
+
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	service, portName, _ := strings.Cut(strings.TrimPrefix(target.URL.Path, "/"), ":")
+	if service == "" {
+		return nil, ErrMissingService
+	}
+
+	config := b.config
+	if target.URL.Host != "" {
+		config.Namespace = target.URL.Host
+	}
+	config.Service = service
+
+	r := &k8sResolver{cc: cc, portName: portName}
+	onSyncComplete := config.OnSyncComplete
+	config.OnSyncComplete = func(statusCode int, duration time.Duration, err error) {
+		if onSyncComplete != nil {
+			onSyncComplete(statusCode, duration, err)
+		}
+		r.syncComplete(err)
+	}
+	r.lb = endpoints.New(&config)
+	r.lb.AddListener(r.update)
+	if err := r.lb.StartBackgroundSync(); err != nil {
+		r.lb.Shutdown()
+		return nil, err
+	}
+
+	// The result of the first list request reaches the ClientConn through
+	// OnSyncComplete, without waiting for a watch event or SyncInterval.
+	var ctx context.Context
+	ctx, r.cancel = context.WithCancel(context.Background())
+	go r.lb.SyncEndpointsContext(ctx)
+	return r, nil
+}
+
+type k8sResolver struct {
+	lb       *endpoints.LoadBalancer
+	cc       resolver.ClientConn
+	portName string
+	cancel   context.CancelFunc // stops the first list request
+
+	mu     sync.Mutex
+	pushed bool // the state was pushed since the last failed list request
+	closed bool
+}
+
+// update pushes the addresses of eps to the ClientConn.
+func (r *k8sResolver) update(_, eps []endpoints.Endpoint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.push(eps)
+}
+
+// syncComplete reports a failed list request to the ClientConn. After the
+// first successful one, and the first following a failure, it pushes the
+// state even if the endpoints did not change, so that the ClientConn never
+// waits on a resolver that has nothing new to say.
+func (r *k8sResolver) syncComplete(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if err != nil {
+		r.pushed = false
+		r.cc.ReportError(err)
+		return
+	}
+	if !r.pushed {
+		r.push(r.lb.Endpoints())
+	}
+}
+
+// push sends the addresses of eps to the ClientConn. r.mu must be held.
+func (r *k8sResolver) push(eps []endpoints.Endpoint) {
+	if r.closed {
+		return
+	}
+	addrs := make([]resolver.Address, 0, len(eps))
+	for _, ep := range eps {
+		port := ep.Port
+		if r.portName != "" {
+			var ok bool
+			if port, ok = ep.Ports[r.portName]; !ok {
+				continue
+			}
+		}
+		addrs = append(addrs, resolver.Address{Addr: net.JoinHostPort(ep.Host, port)})
+	}
+	r.cc.UpdateState(resolver.State{Addresses: addrs})
+	r.pushed = true
+}
+
+// ResolveNow does nothing: the LoadBalancer watches the endpoints and
+// pushes every change as it happens.
+func (r *k8sResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+// Close shuts down the LoadBalancer of the resolver.
+func (r *k8sResolver) Close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.cancel()
+	r.lb.Shutdown()
+}
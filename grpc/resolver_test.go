@@ -0,0 +1,172 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package grpc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/endpoints"
+	"google.golang.org/grpc/resolver"
+)
+
+// A fakeClientConn records the states and errors pushed by a resolver.
+// Methods it does not implement panic through the nil embedded interface.
+type fakeClientConn struct {
+	resolver.ClientConn
+	states chan resolver.State
+	errs   chan error
+}
+
+func newFakeClientConn() *fakeClientConn {
+	return &fakeClientConn{
+		states: make(chan resolver.State, 100),
+		errs:   make(chan error, 100),
+	}
+}
+
+func (cc *fakeClientConn) UpdateState(s resolver.State) error {
+	select {
+	case cc.states <- s:
+	default:
+	}
+	return nil
+}
+
+func (cc *fakeClientConn) ReportError(err error) {
+	select {
+	case cc.errs <- err:
+	default:
+	}
+}
+
+// state returns the next state pushed to cc, failing the test if none is
+// pushed within five seconds.
+func (cc *fakeClientConn) state(t *testing.T) resolver.State {
+	t.Helper()
+	select {
+	case s := <-cc.states:
+		return s
+	case err := <-cc.errs:
+		t.Fatalf("ReportError(%v) while waiting for a state", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for UpdateState")
+	}
+	return resolver.State{}
+}
+
+// apiServer returns a Kubernetes API server answering list requests with
+// list and holding watch requests open.
+func apiServer(t *testing.T, list http.HandlerFunc) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/watch/") || r.URL.Query().Get("watch") == "true" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		list(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// listEndpoints returns a list handler serving an Endpoints object with
+// subsets.
+func listEndpoints(subsets ...interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":       "Endpoints",
+			"apiVersion": "v1",
+			"metadata":   map[string]string{"name": "test", "namespace": "default", "resourceVersion": "1"},
+			"subsets":    subsets,
+		})
+	}
+}
+
+func build(t *testing.T, s *httptest.Server, config endpoints.Config, target string, cc resolver.ClientConn) resolver.Resolver {
+	t.Helper()
+	config.APIAddr = strings.TrimPrefix(s.URL, "http://")
+	config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewBuilder("kubernetes", &config).Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestResolverAddresses(t *testing.T) {
+	s := apiServer(t, listEndpoints(map[string]interface{}{
+		"addresses": []map[string]string{{"ip": "10.0.0.1"}, {"ip": "10.0.0.2"}},
+		"ports":     []map[string]interface{}{{"name": "http", "port": 8080}, {"name": "grpc", "port": 9000}},
+	}))
+	cc := newFakeClientConn()
+	build(t, s, endpoints.Config{}, "kubernetes://default/test:grpc", cc)
+
+	var got []string
+	for _, a := range cc.state(t).Addresses {
+		got = append(got, a.Addr)
+	}
+	if strings.Join(got, " ") != "10.0.0.1:9000 10.0.0.2:9000" {
+		t.Fatalf("UpdateState() addresses = %v, want the grpc port of both endpoints", got)
+	}
+}
+
+func TestResolverEmptyService(t *testing.T) {
+	s := apiServer(t, listEndpoints())
+	cc := newFakeClientConn()
+	build(t, s, endpoints.Config{}, "kubernetes://default/test", cc)
+
+	if got := cc.state(t); len(got.Addresses) != 0 {
+		t.Fatalf("UpdateState() addresses = %v, want none", got.Addresses)
+	}
+}
+
+func TestResolverReportsSyncErrors(t *testing.T) {
+	s := apiServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+	codes := make(chan int, 100)
+	config := endpoints.Config{OnSyncComplete: func(statusCode int, _ time.Duration, _ error) {
+		select {
+		case codes <- statusCode:
+		default:
+		}
+	}}
+	cc := newFakeClientConn()
+	build(t, s, config, "kubernetes://default/test", cc)
+
+	select {
+	case err := <-cc.errs:
+		if err == nil {
+			t.Fatal("ReportError(nil)")
+		}
+	case s := <-cc.states:
+		t.Fatalf("UpdateState(%v) after a failed list request", s)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for ReportError")
+	}
+	select {
+	case code := <-codes:
+		if code != http.StatusForbidden {
+			t.Fatalf("OnSyncComplete() status code = %d, want %d", code, http.StatusForbidden)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnSyncComplete set in the config was not called")
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+)
+
+// ServeHTTP serves the current endpoints as JSON so other processes can
+// share a single LoadBalancer. Requests whose path ends in "/next" receive
+// the next endpoint in rotation; all other requests receive the list of
+// endpoints. The optional "port" query parameter selects a named port and
+// sets the Port of the returned endpoints to it, and the optional
+// "protocol" parameter restricts it to a transport protocol such as "UDP".
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	portName := r.URL.Query().Get("port")
+	protocol := r.URL.Query().Get("protocol")
+
+	var v interface{}
+	var err error
+	if path.Base(r.URL.Path) == "next" {
+		if portName != "" {
+			v, err = lb.NextForPortProtocol(portName, protocol)
+		} else {
+			v, err = lb.Next()
+		}
+	} else {
+		if portName != "" {
+			v, err = lb.Select(SelectOptions{PortName: portName, Protocol: protocol})
+		} else {
+			v = lb.Endpoints()
+		}
+	}
+
+	switch err {
+	case nil:
+	case ErrAmbiguousPort:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// serve sends a request with method for target to lb and returns the
+// recorded response.
+func serve(lb *LoadBalancer, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+func handlerFixture(config *Config) *LoadBalancer {
+	return newFromSubsets(config, subset{
+		Addresses: addresses("10.0.0.1", "10.0.0.2"),
+		Ports:     []port{{Name: "http", Port: 8080}, {Name: "grpc", Port: 9000}},
+	})
+}
+
+func TestServeHTTPEndpoints(t *testing.T) {
+	lb := handlerFixture(&Config{})
+	tests := []struct {
+		target string
+		port   string
+	}{
+		{"/", "8080"},
+		{"/endpoints", "8080"},
+		{"/?port=grpc", "9000"},
+		{"/?port=grpc&protocol=tcp", "9000"},
+	}
+	for _, tt := range tests {
+		w := serve(lb, http.MethodGet, tt.target)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, want 200", tt.target, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("GET %s: Content-Type = %q", tt.target, ct)
+		}
+		var eps []Endpoint
+		if err := json.NewDecoder(w.Body).Decode(&eps); err != nil {
+			t.Fatalf("GET %s: %v", tt.target, err)
+		}
+		if len(eps) != 2 {
+			t.Fatalf("GET %s: got %d endpoints, want 2", tt.target, len(eps))
+		}
+		for _, e := range eps {
+			if e.Port != tt.port {
+				t.Fatalf("GET %s: endpoint %s has Port %s, want %s", tt.target, e.Host, e.Port, tt.port)
+			}
+		}
+	}
+}
+
+func TestServeHTTPNext(t *testing.T) {
+	lb := handlerFixture(&Config{})
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		w := serve(lb, http.MethodGet, "/next?port=grpc")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /next: status = %d, want 200", w.Code)
+		}
+		var e Endpoint
+		if err := json.NewDecoder(w.Body).Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Port != "9000" {
+			t.Fatalf("GET /next?port=grpc: Port = %s, want 9000", e.Port)
+		}
+		seen[e.Host] = true
+	}
+	if len(seen) != 2 {
+		t.Fatalf("GET /next returned %v twice, want each endpoint in turn", seen)
+	}
+}
+
+func TestServeHTTPErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		method string
+		target string
+		code   int
+	}{
+		{"method", Config{}, http.MethodPost, "/", http.StatusMethodNotAllowed},
+		{"missing port", Config{}, http.MethodGet, "/next?port=admin", http.StatusServiceUnavailable},
+		{"ambiguous port", Config{RequireExplicitPort: true}, http.MethodGet, "/next", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		lb := handlerFixture(&tt.config)
+		if w := serve(lb, tt.method, tt.target); w.Code != tt.code {
+			t.Errorf("%s: %s %s: status = %d, want %d", tt.name, tt.method, tt.target, w.Code, tt.code)
+		}
+	}
+
+	if w := serve(New(&Config{}), http.MethodGet, "/next"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /next without endpoints: status = %d, want 503", w.Code)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import "hash/fnv"
+
+// Pick returns the endpoint key maps to, so that requests sharing a key,
+// such as a user ID, consistently reach the same endpoint. Keys are mapped
+// with rendezvous hashing over the selectable endpoints: when an endpoint
+// is added, removed or excluded, only the keys mapped to it move, and all
+// other keys keep their endpoint. Weights are not considered.
+func (lb *LoadBalancer) Pick(key string) (Endpoint, error) {
+	if lb.requireExplicitPort {
+		return Endpoint{}, ErrAmbiguousPort
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if err := lb.unavailable(); err != nil {
+		return Endpoint{}, err
+	}
+	lb.updateLocality()
+
+	var best Endpoint
+	var bestScore uint64
+	found := false
+	for _, ep := range lb.endpoints {
+		if !lb.selectable(ep) {
+			continue
+		}
+		if score := rendezvousScore(key, ep.key()); !found || score > bestScore {
+			best, bestScore, found = ep, score, true
+		}
+	}
+	if !found {
+		return Endpoint{}, ErrNoEndpoints
+	}
+	return lb.selected(best, nil)
+}
+
+// rendezvousScore returns the score of the endpoint with the given key for
+// key. The endpoint with the highest score wins.
+func rendezvousScore(key, endpointKey string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(endpointKey))
+	return mix64(h.Sum64())
+}
+
+// mix64 is the finalizer of SplitMix64. It spreads the FNV hashes of
+// similar inputs, which differ mostly in their low bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPickMinimalRemapping(t *testing.T) {
+	var eps []Endpoint
+	for i := 1; i <= 10; i++ {
+		eps = append(eps, ep(fmt.Sprintf("10.0.0.%d", i), "80"))
+	}
+	lb := newStatic(&Config{}, eps...)
+
+	const keys = 1000
+	before := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		endpoint, err := lb.Pick(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, _ := lb.Pick(key)
+		if again.Host != endpoint.Host {
+			t.Fatalf("Pick(%q) = %s, then %s", key, endpoint.Host, again.Host)
+		}
+		before[key] = endpoint.Host
+	}
+
+	removed := eps[3].Host
+	lb.Prime(append(eps[:3:3], eps[4:]...))
+	moved := 0
+	for key, host := range before {
+		endpoint, err := lb.Pick(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case host == removed:
+			moved++
+			if endpoint.Host == removed {
+				t.Fatalf("Pick(%q) = removed endpoint %s", key, removed)
+			}
+		case endpoint.Host != host:
+			t.Fatalf("Pick(%q) moved from %s to %s although %s was removed", key, host, endpoint.Host, removed)
+		}
+	}
+	if moved == 0 || moved > keys/5 {
+		t.Fatalf("%d of %d keys were mapped to the removed endpoint, want about %d", moved, keys, keys/10)
+	}
+}
+
+func TestPickRequireExplicitPort(t *testing.T) {
+	lb := newStatic(&Config{RequireExplicitPort: true}, ep("10.0.0.1", ""))
+	if _, err := lb.Pick("user-1"); err != ErrAmbiguousPort {
+		t.Fatalf("Pick() error = %v, want %v", err, ErrAmbiguousPort)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultMaxConcurrentProbes = 10
+)
+
+// A HealthCheck configures active health checking of endpoints. Endpoints
+// that fail their most recent probe are skipped by Next until a later probe
+// succeeds.
+type HealthCheck struct {
+	// Check probes an endpoint and reports whether it is healthy.
+	Check func(Endpoint) bool
+
+	// Interval is the amount of time between probe rounds.
+	// If zero, a 10 second interval is used.
+	Interval time.Duration
+
+	// MaxConcurrent bounds the number of probes in flight at once. Probes
+	// beyond the limit wait for a free slot. If zero, 10 is used.
+	MaxConcurrent int
+}
+
+// TCPCheck returns a Check function that reports an endpoint healthy if a
+// TCP connection to its Port can be established within timeout.
+func TCPCheck(timeout time.Duration) func(Endpoint) bool {
+	return func(endpoint Endpoint) bool {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(endpoint.Host, endpoint.Port), timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+}
+
+// HTTPCheck returns a Check function that reports an endpoint healthy if a
+// GET request for path on its Port receives a 2xx or 3xx response within
+// timeout. Redirects are not followed.
+func HTTPCheck(path string, timeout time.Duration) func(Endpoint) bool {
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return func(endpoint Endpoint) bool {
+		resp, err := client.Get("http://" + net.JoinHostPort(endpoint.Host, endpoint.Port) + path)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode >= 200 && resp.StatusCode < 400
+	}
+}
+
+// EndpointStatus reports whether an endpoint can currently be selected.
+type EndpointStatus struct {
+	Endpoint Endpoint
+
+	// Healthy reports whether the endpoint passed its last health probe.
+	// Endpoints that were not probed are healthy.
+	Healthy bool
+
+	// LastProbe is when the last round of health probes completed, or
+	// zero if health checking is disabled or has not completed a round.
+	LastProbe time.Time
+
+	// Excluded is why Next skips the endpoint, or empty if it does not:
+	// "unhealthy", "zero weight", "maintenance", "settling" during
+	// MinStableDuration, "busy" when it holds MaxLeasesPerEndpoint
+	// leases, or "remote zone" while LocalZone endpoints are preferred.
+	Excluded string
+}
+
+// EndpointStatuses returns the health and selectability of every current
+// endpoint.
+func (lb *LoadBalancer) EndpointStatuses() []EndpointStatus {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	statuses := make([]EndpointStatus, len(lb.endpoints))
+	for i, ep := range lb.endpoints {
+		statuses[i] = EndpointStatus{
+			Endpoint:  ep,
+			Healthy:   !lb.unhealthy[ep.key()],
+			LastProbe: lb.lastProbe,
+			Excluded:  lb.excludedBecause(ep),
+		}
+	}
+	return statuses
+}
+
+func (hc *HealthCheck) setDefaults() {
+	if hc.Interval <= 0 {
+		hc.Interval = defaultHealthCheckInterval
+	}
+	if hc.MaxConcurrent <= 0 {
+		hc.MaxConcurrent = defaultMaxConcurrentProbes
+	}
+}
+
+func (lb *LoadBalancer) healthCheckLoop() {
+	for {
+		lb.probeEndpoints()
+		select {
+		case <-time.After(lb.healthCheck.Interval):
+		case <-lb.quit:
+			return
+		}
+	}
+}
+
+// probeEndpoints probes every current endpoint, running at most
+// MaxConcurrent probes at a time, and records which ones failed, emitting
+// an event for every endpoint ejected or recovered.
+func (lb *LoadBalancer) probeEndpoints() {
+	endpoints := lb.Endpoints()
+	healthy := make([]bool, len(endpoints))
+	latencies := make([]time.Duration, len(endpoints))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, lb.healthCheck.MaxConcurrent)
+	for i, endpoint := range endpoints {
+		i, endpoint := i, endpoint
+		sem <- struct{}{}
+		lb.goTracked(&wg, func() {
+			start := time.Now()
+			healthy[i] = lb.healthCheck.Check(endpoint)
+			latencies[i] = time.Since(start)
+			<-sem
+		})
+	}
+	wg.Wait()
+
+	unhealthy := make(map[string]bool)
+	for i, endpoint := range endpoints {
+		if !healthy[i] {
+			unhealthy[endpoint.key()] = true
+		}
+	}
+
+	lb.mu.Lock()
+	previous := lb.unhealthy
+	lb.unhealthy = unhealthy
+	lb.lastProbe = lb.now()
+	for i, endpoint := range endpoints {
+		if s := lb.statsFor(endpoint); s != nil && healthy[i] {
+			s.ProbeLatency = latencies[i]
+		}
+	}
+	lb.mu.Unlock()
+
+	for _, endpoint := range endpoints {
+		key := endpoint.key()
+		switch {
+		case unhealthy[key] && !previous[key]:
+			lb.emit(EndpointEjected, "", endpoint)
+		case !unhealthy[key] && previous[key]:
+			lb.emit(EndpointRecovered, "", endpoint)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeEjectionEvents(t *testing.T) {
+	var down atomic.Value
+	down.Store("10.0.0.1")
+	lb := newStatic(&Config{HealthCheck: &HealthCheck{
+		Check: func(e Endpoint) bool { return e.Host != down.Load().(string) },
+	}}, ep("10.0.0.1", "80"), ep("10.0.0.2", "80"))
+	drainEvents(lb)
+
+	lb.probeEndpoints()
+	events := drainEvents(lb)
+	if got := eventsOf(events, EndpointEjected); len(got) != 1 || got[0] != "10.0.0.1" {
+		t.Fatalf("ejected = %v, want [10.0.0.1]", got)
+	}
+	for i := 0; i < 4; i++ {
+		if got, _ := lb.Next(); got.Host != "10.0.0.2" {
+			t.Fatalf("Next() = %s, which failed its probe", got.Host)
+		}
+	}
+
+	lb.probeEndpoints()
+	if events := drainEvents(lb); len(events) != 0 {
+		t.Fatalf("unchanged probe results emitted %v", events)
+	}
+
+	down.Store("10.0.0.2")
+	lb.probeEndpoints()
+	events = drainEvents(lb)
+	if got := eventsOf(events, EndpointRecovered); len(got) != 1 || got[0] != "10.0.0.1" {
+		t.Fatalf("recovered = %v, want [10.0.0.1]", got)
+	}
+	if got := eventsOf(events, EndpointEjected); len(got) != 1 || got[0] != "10.0.0.2" {
+		t.Fatalf("ejected = %v, want [10.0.0.2]", got)
+	}
+}
+
+func TestProbeMaxConcurrent(t *testing.T) {
+	var inFlight, peak, probed int64
+	check := func(Endpoint) bool {
+		n := atomic.AddInt64(&inFlight, 1)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(2 * time.Millisecond)
+		atomic.AddInt64(&inFlight, -1)
+		atomic.AddInt64(&probed, 1)
+		return true
+	}
+
+	eps := make([]Endpoint, 50)
+	for i := range eps {
+		eps[i] = ep(fmt.Sprintf("10.0.0.%d", i+1), "80")
+	}
+	lb := newStatic(&Config{HealthCheck: &HealthCheck{Check: check, MaxConcurrent: 5}}, eps...)
+
+	lb.probeEndpoints()
+	if probed != 50 {
+		t.Fatalf("probed %d endpoints, want 50", probed)
+	}
+	if peak > 5 {
+		t.Fatalf("%d probes ran at once, want at most 5", peak)
+	}
+	if peak < 2 {
+		t.Fatalf("at most %d probe ran at once, want probes to run concurrently", peak)
+	}
+}
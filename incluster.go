@@ -0,0 +1,65 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ErrNotInCluster is returned by ConfigInCluster when the environment of a
+// pod running in a Kubernetes cluster is missing.
+var ErrNotInCluster = errors.New("endpoints: not running in a Kubernetes cluster")
+
+// ConfigInCluster returns a Config for a LoadBalancer running in a pod. It
+// talks to the API server directly over HTTPS, at the address given by the
+// KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT environment variables,
+// trusting the cluster CA and authenticating with the service account token
+// of the pod. Namespace is set to the namespace of the pod. The caller sets
+// Service and any other fields before passing the Config to New.
+//
+// An error wrapping ErrNotInCluster is returned if the environment variables
+// or service account files are missing.
+func ConfigInCluster() (*Config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("%w: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set", ErrNotInCluster)
+	}
+
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotInCluster, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("endpoints: no certificates found in " + caFile)
+	}
+
+	namespace, err := ioutil.ReadFile(namespaceFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotInCluster, err)
+	}
+	if _, err := os.Stat(tokenFile); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotInCluster, err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	return &Config{
+		APIAddr:         net.JoinHostPort(host, port),
+		BearerTokenFile: tokenFile,
+		Client:          &http.Client{Transport: transport},
+		Namespace:       strings.TrimSpace(string(namespace)),
+		Scheme:          "https",
+	}, nil
+}
@@ -4,6 +4,12 @@
 
 package endpoints
 
+import "encoding/json"
+
+// The types below mirror the Kubernetes v1 API objects. Fields the package
+// does not use are still declared so that objects decode when StrictJSON
+// rejects unknown fields.
+
 type object struct {
 	Object endpoints `json:"object"`
 	Type   string    `json:"type"`
@@ -15,27 +21,132 @@ type endpoints struct {
 	Metadata   metadata `json:"metadata"`
 	Subsets    []subset `json:"subsets"`
 	Message    string   `json:"message"`
+
+	// Status fields, set when a watch delivers an ERROR event.
+	Status  string          `json:"status"`
+	Reason  string          `json:"reason"`
+	Details json.RawMessage `json:"details"`
+	Code    int             `json:"code"`
 }
 
+func (e *endpoints) kind() string { return e.Kind }
+
+type endpointsList struct {
+	Kind       string      `json:"kind"`
+	ApiVersion string      `json:"apiVersion"`
+	Metadata   metadata    `json:"metadata"`
+	Items      []endpoints `json:"items"`
+}
+
+func (l *endpointsList) kind() string { return l.Kind }
+
+// metadata holds both object and list metadata.
 type metadata struct {
-	Name string `json:"name"`
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations"`
+
+	GenerateName               string            `json:"generateName"`
+	Namespace                  string            `json:"namespace"`
+	SelfLink                   string            `json:"selfLink"`
+	UID                        string            `json:"uid"`
+	ResourceVersion            string            `json:"resourceVersion"`
+	Generation                 int64             `json:"generation"`
+	CreationTimestamp          string            `json:"creationTimestamp"`
+	DeletionTimestamp          string            `json:"deletionTimestamp"`
+	DeletionGracePeriodSeconds *int64            `json:"deletionGracePeriodSeconds"`
+	Labels                     map[string]string `json:"labels"`
+	OwnerReferences            json.RawMessage   `json:"ownerReferences"`
+	Finalizers                 []string          `json:"finalizers"`
+	ManagedFields              json.RawMessage   `json:"managedFields"`
+	Continue                   string            `json:"continue"`
+	RemainingItemCount         *int64            `json:"remainingItemCount"`
 }
 
 type subset struct {
-	Addresses []address `json:"addresses"`
-	Ports     []port    `json:"ports"`
+	Addresses         []address `json:"addresses"`
+	NotReadyAddresses []address `json:"notReadyAddresses"`
+	Ports             []port    `json:"ports"`
+
+	namespace string // set for subsets merged from several objects
 }
 
 type address struct {
-	IP string `json:"ip"`
+	IP        string           `json:"ip"`
+	Hostname  string           `json:"hostname"`
+	NodeName  string           `json:"nodeName"`
+	TargetRef *objectReference `json:"targetRef"`
+
+	zone string // set for addresses taken from an EndpointSlice
+}
+
+type objectReference struct {
+	Kind            string `json:"kind"`
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	UID             string `json:"uid"`
+	ApiVersion      string `json:"apiVersion"`
+	ResourceVersion string `json:"resourceVersion"`
+	FieldPath       string `json:"fieldPath"`
 }
 
 type port struct {
-	Name string `json:"name"`
-	Port int32  `json:"port"`
+	Name        string `json:"name"`
+	Port        int32  `json:"port"`
+	Protocol    string `json:"protocol"`
+	AppProtocol string `json:"appProtocol"`
+}
+
+// The types below mirror the Kubernetes discovery.k8s.io/v1 API objects.
+
+type sliceObject struct {
+	Object endpointSlice `json:"object"`
+	Type   string        `json:"type"`
+}
+
+type endpointSlice struct {
+	Kind        string          `json:"kind"`
+	ApiVersion  string          `json:"apiVersion"`
+	Metadata    metadata        `json:"metadata"`
+	AddressType string          `json:"addressType"`
+	Endpoints   []sliceEndpoint `json:"endpoints"`
+	Ports       []port          `json:"ports"`
+	Message     string          `json:"message"`
+
+	// Status fields, set when a watch delivers an ERROR event.
+	Status  string          `json:"status"`
+	Reason  string          `json:"reason"`
+	Details json.RawMessage `json:"details"`
+	Code    int             `json:"code"`
+}
+
+type endpointSliceList struct {
+	Kind       string          `json:"kind"`
+	ApiVersion string          `json:"apiVersion"`
+	Metadata   metadata        `json:"metadata"`
+	Items      []endpointSlice `json:"items"`
+}
+
+func (l *endpointSliceList) kind() string { return l.Kind }
+
+type sliceEndpoint struct {
+	Addresses          []string          `json:"addresses"`
+	Conditions         sliceConditions   `json:"conditions"`
+	Hostname           string            `json:"hostname"`
+	NodeName           string            `json:"nodeName"`
+	Zone               string            `json:"zone"`
+	TargetRef          *objectReference  `json:"targetRef"`
+	Hints              json.RawMessage   `json:"hints"`
+	DeprecatedTopology map[string]string `json:"deprecatedTopology"`
+}
+
+type sliceConditions struct {
+	Ready       *bool `json:"ready"`
+	Serving     *bool `json:"serving"`
+	Terminating *bool `json:"terminating"`
 }
 
 type status struct {
 	Message string `json:"message"`
+	Reason  string `json:"reason"`
 	Code    int    `json:"code"`
 }
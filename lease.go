@@ -0,0 +1,122 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import "sync"
+
+// maxLeaseAttempts bounds how many selections nextLease makes while other
+// goroutines keep taking the last lease of the selected endpoint.
+const maxLeaseAttempts = 3
+
+// nextLease selects the next endpoint that is not one of the avoid
+// endpoints and takes a lease on it. The returned release function gives
+// the lease back and may be called more than once.
+func (lb *LoadBalancer) nextLease(avoid ...Endpoint) (Endpoint, func(), error) {
+	next := lb.Next
+	if len(avoid) > 0 {
+		next = func() (Endpoint, error) { return lb.NextExcept(avoid...) }
+	}
+	for i := 0; i < maxLeaseAttempts; i++ {
+		endpoint, err := next()
+		if err != nil {
+			return Endpoint{}, nil, err
+		}
+		if release, ok := lb.lease(endpoint); ok {
+			return endpoint, release, nil
+		}
+	}
+	return Endpoint{}, nil, ErrAllEndpointsBusy
+}
+
+// Acquire selects the endpoint with the fewest leases outstanding, as
+// taken by Acquire and by the RoundTripper returned by Transport, and takes
+// a lease on it. Ties are broken in round-robin order; weights only matter
+// in that endpoints weighted zero are skipped. The returned release
+// function gives the lease back once the work sent to the endpoint is done,
+// and may be called more than once. Leases are kept by Host and Port, so
+// they carry over updates that keep the endpoint.
+func (lb *LoadBalancer) Acquire() (Endpoint, func(), error) {
+	if lb.requireExplicitPort {
+		return Endpoint{}, nil, ErrAmbiguousPort
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if err := lb.unavailable(); err != nil {
+		return Endpoint{}, nil, err
+	}
+	lb.updateLocality()
+
+	n := len(lb.endpoints)
+	best := -1
+	for i := 0; i < n; i++ {
+		j := (lb.currentEndpoint + i) % n
+		ep := lb.endpoints[j]
+		if !lb.selectable(ep) {
+			continue
+		}
+		if best < 0 || lb.leases[ep.key()] < lb.leases[lb.endpoints[best].key()] {
+			best = j
+		}
+	}
+	if best < 0 {
+		if lb.anySaturated() {
+			return Endpoint{}, nil, ErrAllEndpointsBusy
+		}
+		return Endpoint{}, nil, ErrNoEndpoints
+	}
+
+	lb.currentEndpoint = (best + 1) % n
+	endpoint, _ := lb.selected(lb.endpoints[best], nil)
+	return endpoint, lb.leaseLocked(endpoint.key()), nil
+}
+
+// lease takes a lease on endpoint unless it already holds the maximum.
+func (lb *LoadBalancer) lease(endpoint Endpoint) (func(), bool) {
+	key := endpoint.key()
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.saturated(key) {
+		return nil, false
+	}
+	return lb.leaseLocked(key), true
+}
+
+// leaseLocked takes a lease on the endpoint with the given key and returns
+// the function giving it back. lb.mu must be held.
+func (lb *LoadBalancer) leaseLocked(key string) func() {
+	if lb.leases == nil {
+		lb.leases = make(map[string]int)
+	}
+	lb.leases[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			lb.mu.Lock()
+			defer lb.mu.Unlock()
+			if lb.leases[key]--; lb.leases[key] <= 0 {
+				delete(lb.leases, key)
+			}
+		})
+	}
+}
+
+// saturated reports whether the endpoint with the given key holds
+// MaxLeasesPerEndpoint leases. lb.mu must be held.
+func (lb *LoadBalancer) saturated(key string) bool {
+	return lb.maxLeases > 0 && lb.leases[key] >= lb.maxLeases
+}
+
+// anySaturated reports whether any current endpoint is saturated. lb.mu
+// must be held.
+func (lb *LoadBalancer) anySaturated() bool {
+	for _, ep := range lb.endpoints {
+		if lb.saturated(ep.key()) {
+			return true
+		}
+	}
+	return false
+}
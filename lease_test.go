@@ -0,0 +1,80 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import "testing"
+
+func TestAcquireFewestLeases(t *testing.T) {
+	lb := newStatic(&Config{}, ep("10.0.0.1", "80"), ep("10.0.0.2", "80"), ep("10.0.0.3", "80"))
+	first, release, err := lb.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{first.Host: true}
+	for i := 0; i < 2; i++ {
+		endpoint, _, err := lb.Acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[endpoint.Host] {
+			t.Fatalf("Acquire() = %s, which already holds a lease", endpoint.Host)
+		}
+		seen[endpoint.Host] = true
+	}
+
+	release()
+	endpoint, _, err := lb.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Host != first.Host {
+		t.Fatalf("Acquire() = %s, want released endpoint %s", endpoint.Host, first.Host)
+	}
+}
+
+func TestAcquireRequireExplicitPort(t *testing.T) {
+	lb := newStatic(&Config{RequireExplicitPort: true}, ep("10.0.0.1", ""))
+	if _, _, err := lb.Acquire(); err != ErrAmbiguousPort {
+		t.Fatalf("Acquire() error = %v, want %v", err, ErrAmbiguousPort)
+	}
+}
+
+func TestAcquireTieBreakRotates(t *testing.T) {
+	lb := NewStatic(
+		Endpoint{Host: "10.0.0.1", Port: "80"},
+		Endpoint{Host: "10.0.0.2", Port: "80"},
+		Endpoint{Host: "10.0.0.3", Port: "80"},
+		Endpoint{Host: "10.0.0.4", Port: "80"},
+	)
+	busy, _, err := lb.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The other endpoints tie with no leases, and releasing each lease at
+	// once keeps them tied.
+	counts := make(map[string]int)
+	var last string
+	for i := 0; i < 9; i++ {
+		endpoint, release, err := lb.Acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+		if endpoint.Host == last {
+			t.Fatalf("Acquire() returned %s twice in a row", last)
+		}
+		last = endpoint.Host
+		counts[endpoint.Host]++
+	}
+	if counts[busy.Host] != 0 {
+		t.Fatalf("Acquire() returned %s, which holds a lease, over idle endpoints", busy.Host)
+	}
+	for host, n := range counts {
+		if n != 3 {
+			t.Fatalf("Acquire() returned %s %d times of 9, want 3 for each idle endpoint (%v)", host, n, counts)
+		}
+	}
+}
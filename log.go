@@ -0,0 +1,30 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// logError logs err. With a Logger, msg is the log message and attrs are
+// added to it along with the error, the namespace and service, and the URL
+// and status code of a SyncError. Otherwise err is printed to ErrorLog.
+func (lb *LoadBalancer) logError(err error, msg string, attrs ...any) {
+	if lb.logger == nil {
+		lb.errorLog.Println(err)
+		return
+	}
+	attrs = append(attrs,
+		slog.String("namespace", lb.namespace),
+		slog.String("service", lb.service),
+		slog.Any("error", err),
+	)
+	var syncErr *SyncError
+	if errors.As(err, &syncErr) {
+		attrs = append(attrs, slog.String("url", syncErr.URL), slog.Int("code", syncErr.Code))
+	}
+	lb.logger.Error(msg, attrs...)
+}
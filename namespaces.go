@@ -0,0 +1,126 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"fmt"
+	"sort"
+)
+
+// AllNamespaces, given as the only element of Config.Namespaces, watches
+// the service in every namespace.
+const AllNamespaces = "*"
+
+// Cluster-wide paths used when watching several namespaces. Objects in
+// namespaces that are not watched are filtered out by the LoadBalancer.
+const (
+	endpointsAllPath      = "/api/v1/endpoints?fieldSelector=metadata.name%%3D%s"
+	endpointsAllWatchPath = "/api/v1/watch/endpoints?fieldSelector=metadata.name%%3D%s"
+	slicesAllPath         = "/apis/discovery.k8s.io/v1/endpointslices?labelSelector=kubernetes.io%%2Fservice-name%%3D%s"
+	slicesAllWatchPath    = slicesAllPath + "&watch=true"
+)
+
+// namespaceSet returns the set of namespaces, or nil if none are given.
+func namespaceSet(namespaces []string) map[string]bool {
+	if len(namespaces) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		set[ns] = true
+	}
+	return set
+}
+
+// multiNamespace reports whether the service is watched in several
+// namespaces rather than in Namespace only.
+func (lb *LoadBalancer) multiNamespace() bool {
+	return len(lb.namespaces) > 0
+}
+
+// watchesNamespace reports whether objects in namespace are used.
+func (lb *LoadBalancer) watchesNamespace(namespace string) bool {
+	return !lb.multiNamespace() || lb.namespaces[AllNamespaces] || lb.namespaces[namespace]
+}
+
+// listPath returns the path listing the objects of the service.
+func (lb *LoadBalancer) listPath() string {
+	switch {
+	case lb.useEndpointSlices && lb.multiNamespace():
+		return fmt.Sprintf(slicesAllPath, lb.service)
+	case lb.useEndpointSlices:
+		return fmt.Sprintf(slicesPath, lb.namespace, lb.service)
+	case lb.multiNamespace():
+		return fmt.Sprintf(endpointsAllPath, lb.service)
+	}
+	return fmt.Sprintf(endpointsPath, lb.namespace, lb.service)
+}
+
+// watchBasePath returns the path watching the objects of the service,
+// before the resource version to resume from is added.
+func (lb *LoadBalancer) watchBasePath() string {
+	switch {
+	case lb.useEndpointSlices && lb.multiNamespace():
+		return fmt.Sprintf(slicesAllWatchPath, lb.service)
+	case lb.useEndpointSlices:
+		return fmt.Sprintf(slicesWatchPath, lb.namespace, lb.service)
+	case lb.multiNamespace():
+		return fmt.Sprintf(endpointsAllWatchPath, lb.service)
+	}
+	return fmt.Sprintf(endpointsWatchPath, lb.namespace, lb.service)
+}
+
+// replaceNamespaces replaces the known Endpoints objects of the service
+// with those of list in watched namespaces and returns them combined into
+// a single Endpoints object.
+func (lb *LoadBalancer) replaceNamespaces(list endpointsList) endpoints {
+	lb.slicesMu.Lock()
+	defer lb.slicesMu.Unlock()
+	lb.byNamespace = make(map[string]endpoints, len(list.Items))
+	for _, eps := range list.Items {
+		if lb.watchesNamespace(eps.Metadata.Namespace) {
+			lb.byNamespace[eps.Metadata.Namespace] = eps
+		}
+	}
+	return lb.mergeNamespaces(list.Metadata.ResourceVersion)
+}
+
+// applyNamespaceEvent applies a watch event to the known Endpoints objects
+// of the service and returns them combined into a single Endpoints object,
+// and whether any object remains.
+func (lb *LoadBalancer) applyNamespaceEvent(o object) (endpoints, bool) {
+	lb.slicesMu.Lock()
+	defer lb.slicesMu.Unlock()
+	if lb.byNamespace == nil {
+		lb.byNamespace = make(map[string]endpoints)
+	}
+	ns := o.Object.Metadata.Namespace
+	if o.Type == "DELETED" {
+		delete(lb.byNamespace, ns)
+	} else if lb.watchesNamespace(ns) {
+		lb.byNamespace[ns] = o.Object
+	}
+	return lb.mergeNamespaces(o.Object.Metadata.ResourceVersion), len(lb.byNamespace) > 0
+}
+
+// mergeNamespaces returns an Endpoints object holding the subsets of every
+// known Endpoints object, ordered by namespace, each tagged with its
+// namespace. lb.slicesMu must be held.
+func (lb *LoadBalancer) mergeNamespaces(resourceVersion string) endpoints {
+	namespaces := make([]string, 0, len(lb.byNamespace))
+	for ns := range lb.byNamespace {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	eps := endpoints{Metadata: metadata{Name: lb.service, ResourceVersion: resourceVersion}}
+	for _, ns := range namespaces {
+		for _, subset := range lb.byNamespace[ns].Subsets {
+			subset.namespace = ns
+			eps.Subsets = append(eps.Subsets, subset)
+		}
+	}
+	return eps
+}
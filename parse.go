@@ -0,0 +1,69 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ParseEndpointsList decodes a Kubernetes EndpointsList, such as the
+// response to listing /api/v1/namespaces/<namespace>/endpoints, and returns
+// the endpoints of every service in it keyed by service name. The result can
+// be used to prime several LoadBalancers with a single API call.
+func ParseEndpointsList(r io.Reader) (map[string][]Endpoint, error) {
+	var list endpointsList
+	err := json.NewDecoder(r).Decode(&list)
+	if err != nil {
+		return nil, err
+	}
+
+	var lb LoadBalancer
+	eps := make(map[string][]Endpoint, len(list.Items))
+	for _, item := range list.Items {
+		eps[item.Metadata.Name] = lb.formatEndpoints(item)
+	}
+	return eps, nil
+}
+
+// Prime replaces the current set of endpoints, typically with endpoints
+// returned by ParseEndpointsList, before the first sync completes.
+// Endpoints with a zero Weight are given the default weight of 1.
+func (lb *LoadBalancer) Prime(endpoints []Endpoint) {
+	eps := make([]Endpoint, len(endpoints))
+	copy(eps, endpoints)
+	for i := range eps {
+		if eps[i].Weight == 0 {
+			eps[i].Weight = 1
+		}
+	}
+	lb.update(eps, sourceReconcile)
+}
+
+// NewFromReader returns a LoadBalancer whose endpoints are decoded once from
+// a Kubernetes Endpoints object read from r, such as the output of
+// "kubectl get endpoints <service> -o json". The set is static:
+// StartBackgroundSync and SyncEndpoints should not be called on it.
+func NewFromReader(r io.Reader, config *Config) (*LoadBalancer, error) {
+	lb := New(config)
+
+	var eps endpoints
+	err := lb.decode(r, "", &eps, "Endpoints")
+	if err != nil {
+		return nil, err
+	}
+	lb.apply(eps, sourceReconcile)
+	return lb, nil
+}
+
+// NewStatic returns a LoadBalancer that selects from a fixed set of
+// endpoints without connecting to Kubernetes, for example to test code that
+// accepts a Balancer. Endpoints with a zero Weight are given the default
+// weight of 1.
+func NewStatic(endpoints ...Endpoint) *LoadBalancer {
+	lb := New(&Config{})
+	lb.Prime(endpoints)
+	return lb
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestNewFromReader(t *testing.T) {
+	fixture, err := json.Marshal(endpointsObject("1", subset{
+		Addresses: addresses("10.0.0.1", "10.0.0.2", "10.0.0.3"),
+		Ports:     []port{{Name: "http", Port: 8080}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := NewFromReader(bytes.NewReader(fixture), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hosts []string
+	for i := 0; i < 6; i++ {
+		got, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Port != "8080" {
+			t.Fatalf("Next() Port = %s, want 8080", got.Port)
+		}
+		hosts = append(hosts, got.Host)
+	}
+	for i := 0; i < 3; i++ {
+		if hosts[i] == hosts[(i+1)%3] || hosts[i] != hosts[i+3] {
+			t.Fatalf("Next() returned %v, want the 3 parsed endpoints in rotation", hosts)
+		}
+	}
+	if n := lb.ActiveGoroutines(); n != 0 {
+		t.Fatalf("ActiveGoroutines() = %d, want no background sync", n)
+	}
+
+	if _, err := NewFromReader(bytes.NewReader([]byte(`{"kind":`)), &Config{}); err == nil {
+		t.Fatal("NewFromReader() succeeded for truncated JSON")
+	}
+}
+
+func TestParseEndpointsList(t *testing.T) {
+	fixture, err := json.Marshal(endpointsList{Items: []endpoints{
+		{Metadata: metadata{Name: "web"}, Subsets: []subset{{Addresses: addresses("10.0.0.1", "10.0.0.2"), Ports: []port{{Port: 80}}}}},
+		{Metadata: metadata{Name: "db"}, Subsets: []subset{{Addresses: addresses("10.0.1.1"), Ports: []port{{Port: 5432}}}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := ParseEndpointsList(bytes.NewReader(fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || len(services["web"]) != 2 || len(services["db"]) != 1 || services["db"][0].Port != "5432" {
+		t.Fatalf("ParseEndpointsList() = %v", services)
+	}
+}
+
+func TestNewStatic(t *testing.T) {
+	var b Balancer = NewStatic(ep("10.0.0.1", "80"), Endpoint{Host: "10.0.0.2", Port: "80", Weight: 3})
+
+	eps := b.Endpoints()
+	if len(eps) != 2 || eps[0].Weight != 1 || eps[1].Weight != 3 {
+		t.Fatalf("Endpoints() = %+v, want both endpoints with the zero weight defaulted to 1", eps)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		got, err := b.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[got.Host]++
+	}
+	if counts["10.0.0.1"] != 2 || counts["10.0.0.2"] != 6 {
+		t.Fatalf("Next() selections = %v, want 2 and 6", counts)
+	}
+
+	if _, err := NewStatic().Next(); err != ErrNoEndpoints {
+		t.Fatalf("Next() error = %v for an empty static set, want ErrNoEndpoints", err)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+// NextPreferred returns preferred if it is still a current endpoint that
+// Next may select, and otherwise falls back to Next. Endpoints are matched
+// by Host and Port. It lets callers that already know a good endpoint keep
+// using it without sticky sessions.
+func (lb *LoadBalancer) NextPreferred(preferred Endpoint) (Endpoint, error) {
+	if lb.requireExplicitPort {
+		return Endpoint{}, ErrAmbiguousPort
+	}
+	key := preferred.key()
+
+	lb.mu.Lock()
+	if err := lb.unavailable(); err != nil {
+		lb.mu.Unlock()
+		return Endpoint{}, err
+	}
+	lb.updateLocality()
+	for _, ep := range lb.endpoints {
+		if ep.key() == key && lb.selectable(ep) {
+			defer lb.mu.Unlock()
+			return lb.selected(ep, nil)
+		}
+	}
+	lb.mu.Unlock()
+	return lb.Next()
+}
@@ -0,0 +1,38 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import "testing"
+
+func TestNextPreferred(t *testing.T) {
+	a, b := ep("10.0.0.1", "80"), ep("10.0.0.2", "80")
+	lb := newStatic(&Config{}, a, b)
+	for i := 0; i < 3; i++ {
+		got, err := lb.NextPreferred(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Host != b.Host {
+			t.Fatalf("NextPreferred(%s) = %s while it is present", b.Host, got.Host)
+		}
+	}
+
+	lb.Prime([]Endpoint{a})
+	got, err := lb.NextPreferred(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Host != a.Host {
+		t.Fatalf("NextPreferred(%s) = %s after it was removed, want %s", b.Host, got.Host, a.Host)
+	}
+}
+
+func TestNextPreferredRequireExplicitPort(t *testing.T) {
+	preferred := ep("10.0.0.1", "")
+	lb := newStatic(&Config{RequireExplicitPort: true}, preferred)
+	if _, err := lb.NextPreferred(preferred); err != ErrAmbiguousPort {
+		t.Fatalf("NextPreferred() error = %v, want %v", err, ErrAmbiguousPort)
+	}
+}
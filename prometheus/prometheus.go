@@ -0,0 +1,98 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+// Package prometheus exports metrics about an endpoints.LoadBalancer to
+// Prometheus. It lives in its own package so that users of the endpoints
+// package who do not use Prometheus do not depend on its client library.
+//
+//	config := &endpoints.Config{Service: "nginx"}
+//	if err := prometheus.Instrument(config, prom.DefaultRegisterer); err != nil {
+//	    log.Fatal(err)
+//	}
+//	lb := endpoints.New(config)
+package prometheus
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/endpoints"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Instrument hooks metrics into the callbacks of config and registers them
+// with reg. It must be called before config is passed to endpoints.New.
+// Callbacks already set in config are still called.
+//
+// The metrics are labeled with the namespace and service of config, so
+// several LoadBalancers can share a registry:
+//
+//	endpoints_endpoints               gauge of the current number of endpoints
+//	endpoints_syncs_total             counter of list requests by result
+//	endpoints_watch_reconnects_total  counter of watch reconnects
+//	endpoints_sync_duration_seconds   histogram of list request latency
+func Instrument(config *endpoints.Config, reg prom.Registerer) error {
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = endpoints.DefaultNamespace
+	}
+	labels := prom.Labels{"namespace": namespace, "service": config.Service}
+
+	count := prom.NewGauge(prom.GaugeOpts{
+		Name:        "endpoints_endpoints",
+		Help:        "Current number of endpoints.",
+		ConstLabels: labels,
+	})
+	syncs := prom.NewCounterVec(prom.CounterOpts{
+		Name:        "endpoints_syncs_total",
+		Help:        "Number of list requests to the Kubernetes API by result.",
+		ConstLabels: labels,
+	}, []string{"result"})
+	reconnects := prom.NewCounter(prom.CounterOpts{
+		Name:        "endpoints_watch_reconnects_total",
+		Help:        "Number of times the endpoints watch was re-established.",
+		ConstLabels: labels,
+	})
+	latency := prom.NewHistogram(prom.HistogramOpts{
+		Name:        "endpoints_sync_duration_seconds",
+		Help:        "Latency of list requests to the Kubernetes API.",
+		ConstLabels: labels,
+		Buckets:     prom.DefBuckets,
+	})
+
+	for _, c := range []prom.Collector{count, syncs, reconnects, latency} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+
+	onChange := config.OnChange
+	config.OnChange = func(old, new []endpoints.Endpoint) {
+		count.Set(float64(len(new)))
+		if onChange != nil {
+			onChange(old, new)
+		}
+	}
+
+	onSyncComplete := config.OnSyncComplete
+	config.OnSyncComplete = func(statusCode int, d time.Duration, err error) {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		syncs.WithLabelValues(result).Inc()
+		latency.Observe(d.Seconds())
+		if onSyncComplete != nil {
+			onSyncComplete(statusCode, d, err)
+		}
+	}
+
+	onWatchReconnected := config.OnWatchReconnected
+	config.OnWatchReconnected = func() {
+		reconnects.Inc()
+		if onWatchReconnected != nil {
+			onWatchReconnected()
+		}
+	}
+	return nil
+}
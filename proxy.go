@@ -0,0 +1,70 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+)
+
+// ReverseProxyOptions configures the handler returned by ReverseProxy.
+type ReverseProxyOptions struct {
+	// Retries is the number of other endpoints a request is tried against
+	// after connecting to an endpoint fails. Endpoints the request already
+	// failed against are skipped. Requests with a body are not retried.
+	// If zero, failed requests are not retried.
+	Retries int
+
+	// Scheme is the URL scheme used to reach the endpoints. If empty,
+	// "http" is used.
+	Scheme string
+}
+
+// ReverseProxy returns an http.Handler that proxies every request to the
+// next endpoint. Like the RoundTripper returned by Transport, it honors
+// RequestTimeout, MaxLeasesPerEndpoint and CapacityHeader. Requests that
+// cannot be sent because no endpoint is available receive a 503 response,
+// other failures a 502 response.
+func (lb *LoadBalancer) ReverseProxy(opts ReverseProxyOptions) http.Handler {
+	scheme := opts.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			// The host is replaced by the transport for every attempt.
+			r.URL.Scheme = scheme
+			r.URL.Host = lb.service
+			if _, ok := r.Header["User-Agent"]; !ok {
+				// Keep the proxy from adding a default User-Agent.
+				r.Header.Set("User-Agent", "")
+			}
+		},
+		Transport: &transport{
+			lb:       lb,
+			base:     http.DefaultTransport,
+			attempts: opts.Retries + 1,
+			retry:    isDialError,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			lb.logError(fmt.Errorf("endpoints proxy %s: %w", r.URL.Path, err), "endpoints proxy failed", "path", r.URL.Path)
+			code := http.StatusBadGateway
+			if errors.Is(err, ErrNoEndpoints) || errors.Is(err, ErrNotSynced) || errors.Is(err, ErrDraining) || errors.Is(err, ErrAllEndpointsBusy) {
+				code = http.StatusServiceUnavailable
+			}
+			w.WriteHeader(code)
+		},
+	}
+}
+
+// isDialError reports whether err happened while connecting to an
+// endpoint, before any of the request was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
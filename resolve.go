@@ -0,0 +1,119 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	resolveTimeout = 5 * time.Second
+	resolveTTL     = 30 * time.Second
+)
+
+// A Resolver resolves hostnames to IP addresses. *net.Resolver implements
+// Resolver.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// resolverCache caches the addresses of hostname-only endpoints.
+type resolverCache struct {
+	mu      sync.Mutex
+	entries map[string]*resolvedHost
+}
+
+type resolvedHost struct {
+	addrs    []string
+	at       time.Time
+	resolved bool // addrs holds the result of a lookup
+	pending  bool // a lookup is in flight
+}
+
+// lookupHost returns the cached addresses of host. Missing or stale entries
+// are resolved in the background; once a lookup completes the last
+// Endpoints object is applied again so the addresses take effect.
+func (lb *LoadBalancer) lookupHost(host string) []string {
+	if lb.resolver == nil {
+		return nil
+	}
+
+	c := &lb.resolverCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*resolvedHost)
+	}
+	e, ok := c.entries[host]
+	if !ok {
+		e = &resolvedHost{}
+		c.entries[host] = e
+	}
+	if !e.pending && (!e.resolved || time.Since(e.at) > resolveTTL) {
+		e.pending = true
+		lb.goTracked(nil, func() { lb.resolve(host, e) })
+	}
+	return e.addrs
+}
+
+func (lb *LoadBalancer) resolve(host string, e *resolvedHost) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-lb.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	addrs, err := lb.resolver.LookupHost(ctx, host)
+
+	c := &lb.resolverCache
+	c.mu.Lock()
+	e.pending = false
+	e.at = time.Now()
+	changed := err == nil && !equalStrings(e.addrs, addrs)
+	if err == nil {
+		e.addrs = addrs
+		e.resolved = true
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		lb.logError(fmt.Errorf("endpoints resolve %s: %w", host, err), "endpoints resolve failed", "host", host)
+		return
+	}
+	if changed {
+		lb.reapply()
+	}
+}
+
+// pruneResolverCache drops cached hostnames not in live.
+func (lb *LoadBalancer) pruneResolverCache(live map[string]bool) {
+	c := &lb.resolverCache
+	c.mu.Lock()
+	for host, e := range c.entries {
+		if !live[host] && !e.pending {
+			delete(c.entries, host)
+		}
+	}
+	c.mu.Unlock()
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
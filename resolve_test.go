@@ -0,0 +1,64 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// stubResolver resolves hostnames from a fixed table.
+type stubResolver struct {
+	hosts   map[string][]string
+	lookups int64
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	atomic.AddInt64(&r.lookups, 1)
+	return r.hosts[host], nil
+}
+
+func TestResolveHostnameOnlyAddress(t *testing.T) {
+	resolver := &stubResolver{hosts: map[string][]string{
+		"db.example.com": {"10.0.1.1", "10.0.1.2"},
+		"ip.example.com": {"10.9.9.9"},
+	}}
+	lb := newFromSubsets(&Config{Resolver: resolver}, subset{
+		Addresses: []address{
+			{Hostname: "db.example.com"},
+			{IP: "10.0.0.1", Hostname: "ip.example.com"},
+		},
+		Ports: []port{{Port: 5432}},
+	})
+	defer lb.Shutdown()
+
+	hosts := func() string {
+		var hosts []string
+		for _, e := range lb.Endpoints() {
+			hosts = append(hosts, e.Host)
+		}
+		sort.Strings(hosts)
+		return strings.Join(hosts, ",")
+	}
+	const want = "10.0.0.1,10.0.1.1,10.0.1.2"
+	waitFor(t, "the hostname to resolve", func() bool { return hosts() == want })
+
+	for _, e := range lb.Endpoints() {
+		if strings.HasPrefix(e.Host, "10.0.1.") && e.Hostname != "db.example.com" {
+			t.Errorf("resolved endpoint %s has Hostname %q, want db.example.com", e.Host, e.Hostname)
+		}
+	}
+	// Addresses with an IP are never resolved, and the result is cached.
+	lb.reapply()
+	if got := hosts(); got != want {
+		t.Fatalf("hosts = %s after reapply, want %s", got, want)
+	}
+	if n := atomic.LoadInt64(&resolver.lookups); n != 1 {
+		t.Fatalf("%d lookups, want 1", n)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+// SelectOptions restricts the endpoints returned by Select. Empty fields
+// do not filter.
+type SelectOptions struct {
+	// PortName selects endpoints serving the named port. The Port of each
+	// returned endpoint is set to that port.
+	PortName string
+
+	// Protocol, together with PortName, selects endpoints whose named port
+	// uses the given transport protocol, such as "UDP". It is compared
+	// case-insensitively.
+	Protocol string
+
+	// Zone selects endpoints in the given topology zone.
+	Zone string
+
+	// NodeName selects endpoints hosted on the given node.
+	NodeName string
+
+	// ExcludeDraining skips endpoints taken from not-ready addresses, such
+	// as those of terminating pods, which are only present when
+	// IncludeNotReady is set.
+	ExcludeDraining bool
+}
+
+// Select returns the selectable endpoints matching every option in opts.
+// ErrNoEndpoints is returned if no endpoint matches. Like Next, Select
+// fails while draining or before the endpoints are synced. An explicit
+// Zone takes precedence over the LocalZone preference.
+func (lb *LoadBalancer) Select(opts SelectOptions) ([]Endpoint, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if err := lb.unavailable(); err != nil {
+		return nil, err
+	}
+	lb.updateLocality()
+
+	var eps []Endpoint
+	for _, endpoint := range lb.endpoints {
+		if why := lb.excludedBecause(endpoint); why != "" && (why != "remote zone" || opts.Zone == "") {
+			continue
+		}
+		if opts.ExcludeDraining && lb.includeNotReady && !endpoint.Ready {
+			continue
+		}
+		if opts.Zone != "" && endpoint.Zone != opts.Zone {
+			continue
+		}
+		if opts.NodeName != "" && endpoint.NodeName != opts.NodeName {
+			continue
+		}
+		if opts.PortName != "" {
+			port, ok := endpoint.port(opts.PortName, opts.Protocol)
+			if !ok {
+				continue
+			}
+			endpoint.Port = port
+		}
+		eps = append(eps, endpoint)
+	}
+	if len(eps) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	return eps, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func selectFixture(config *Config) *LoadBalancer {
+	lb := New(config)
+	lb.update([]Endpoint{
+		{Host: "10.0.0.1", Port: "80", Ports: map[string]string{"http": "80", "grpc": "9000"}, Zone: "a", Weight: 1},
+		{Host: "10.0.0.2", Port: "80", Ports: map[string]string{"http": "80"}, Zone: "a", Weight: 1},
+		{Host: "10.0.0.3", Port: "80", Ports: map[string]string{"http": "80", "grpc": "9001"}, Zone: "b", Weight: 1},
+		{Host: "10.0.0.4", Port: "80", Ports: map[string]string{"grpc": "9002"}, Zone: "b", Weight: 1},
+	}, sourceReconcile)
+	return lb
+}
+
+// joinedHostPorts returns the sorted "host:port" of every endpoint in eps.
+func joinedHostPorts(eps []Endpoint) []string {
+	var hs []string
+	for _, ep := range eps {
+		hs = append(hs, ep.Host+":"+ep.Port)
+	}
+	sort.Strings(hs)
+	return hs
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		name string
+		opts SelectOptions
+		want []string
+	}{
+		{"all", SelectOptions{}, []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80"}},
+		{"port", SelectOptions{PortName: "grpc"}, []string{"10.0.0.1:9000", "10.0.0.3:9001", "10.0.0.4:9002"}},
+		{"zone", SelectOptions{Zone: "b"}, []string{"10.0.0.3:80", "10.0.0.4:80"}},
+		{"port and zone", SelectOptions{PortName: "grpc", Zone: "a"}, []string{"10.0.0.1:9000"}},
+	}
+	lb := selectFixture(&Config{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lb.Select(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h := joinedHostPorts(got); fmt.Sprint(h) != fmt.Sprint(tt.want) {
+				t.Fatalf("Select(%+v) = %v, want %v", tt.opts, h, tt.want)
+			}
+		})
+	}
+
+	if _, err := lb.Select(SelectOptions{PortName: "http", Zone: "c"}); err != ErrNoEndpoints {
+		t.Fatalf("Select() error = %v, want %v", err, ErrNoEndpoints)
+	}
+}
+
+func TestSelectLocalZone(t *testing.T) {
+	lb := selectFixture(&Config{LocalZone: "b"})
+	got, err := lb.Select(SelectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := joinedHostPorts(got); fmt.Sprint(h) != "[10.0.0.3:80 10.0.0.4:80]" {
+		t.Fatalf("Select() = %v, want the local zone endpoints", h)
+	}
+
+	got, err = lb.Select(SelectOptions{Zone: "a"})
+	if err != nil {
+		t.Fatalf("Select() of a remote zone error = %v", err)
+	}
+	if h := joinedHostPorts(got); fmt.Sprint(h) != "[10.0.0.1:80 10.0.0.2:80]" {
+		t.Fatalf("Select(Zone: a) = %v, want the zone a endpoints", h)
+	}
+}
+
+func TestSelectExcludeDraining(t *testing.T) {
+	lb := newFromSubsets(&Config{IncludeNotReady: true}, subset{
+		Addresses:         addresses("10.0.0.1"),
+		NotReadyAddresses: addresses("10.0.0.2"),
+		Ports:             []port{{Port: 80}},
+	})
+	for _, tt := range []struct {
+		opts SelectOptions
+		want string
+	}{
+		{SelectOptions{}, "[10.0.0.1:80 10.0.0.2:80]"},
+		{SelectOptions{ExcludeDraining: true}, "[10.0.0.1:80]"},
+	} {
+		got, err := lb.Select(tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := joinedHostPorts(got); fmt.Sprint(h) != tt.want {
+			t.Fatalf("Select(%+v) = %v, want %s", tt.opts, h, tt.want)
+		}
+	}
+}
+
+func TestSelectUnavailable(t *testing.T) {
+	if _, err := New(&Config{}).Select(SelectOptions{}); err != ErrNotSynced {
+		t.Fatalf("Select() before sync error = %v, want %v", err, ErrNotSynced)
+	}
+	lb := selectFixture(&Config{})
+	lb.Drain()
+	if _, err := lb.Select(SelectOptions{}); err != ErrDraining {
+		t.Fatalf("Select() while draining error = %v, want %v", err, ErrDraining)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import "sort"
+
+// replaceSlices replaces the known EndpointSlices of the service with those
+// of list and returns them combined into an Endpoints object.
+func (lb *LoadBalancer) replaceSlices(list endpointSliceList) endpoints {
+	lb.slicesMu.Lock()
+	defer lb.slicesMu.Unlock()
+	lb.slices = make(map[string]endpointSlice, len(list.Items))
+	for _, s := range list.Items {
+		if lb.watchesNamespace(s.Metadata.Namespace) {
+			lb.slices[sliceKey(s)] = s
+		}
+	}
+	return lb.mergeSlices(list.Metadata.ResourceVersion)
+}
+
+// applySliceEvent applies a watch event to the known EndpointSlices of the
+// service and returns them combined into an Endpoints object, and whether
+// any slice remains.
+func (lb *LoadBalancer) applySliceEvent(o sliceObject) (endpoints, bool) {
+	lb.slicesMu.Lock()
+	defer lb.slicesMu.Unlock()
+	if lb.slices == nil {
+		lb.slices = make(map[string]endpointSlice)
+	}
+	if o.Type == "DELETED" {
+		delete(lb.slices, sliceKey(o.Object))
+	} else if lb.watchesNamespace(o.Object.Metadata.Namespace) {
+		lb.slices[sliceKey(o.Object)] = o.Object
+	}
+	return lb.mergeSlices(o.Object.Metadata.ResourceVersion), len(lb.slices) > 0
+}
+
+// sliceKey identifies an EndpointSlice among those of the service, which
+// may span several namespaces.
+func sliceKey(s endpointSlice) string {
+	return s.Metadata.Namespace + "/" + s.Metadata.Name
+}
+
+// mergeSlices returns an Endpoints object with one subset per known
+// EndpointSlice, ordered by namespace and slice name, each tagged with its
+// namespace. lb.slicesMu must be held.
+func (lb *LoadBalancer) mergeSlices(resourceVersion string) endpoints {
+	names := make([]string, 0, len(lb.slices))
+	for name := range lb.slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	eps := endpoints{Metadata: metadata{Name: lb.service, ResourceVersion: resourceVersion}}
+	for _, name := range names {
+		s := lb.slices[name]
+		subset := sliceSubset(s)
+		subset.namespace = s.Metadata.Namespace
+		eps.Subsets = append(eps.Subsets, subset)
+	}
+	return eps
+}
+
+// sliceSubset converts an EndpointSlice into an Endpoints subset. Addresses
+// whose ready condition is unset count as ready, as the API specifies.
+func sliceSubset(s endpointSlice) subset {
+	sub := subset{Ports: s.Ports}
+	for _, ep := range s.Endpoints {
+		for _, a := range ep.Addresses {
+			addr := address{
+				Hostname:  ep.Hostname,
+				NodeName:  ep.NodeName,
+				TargetRef: ep.TargetRef,
+				zone:      ep.Zone,
+			}
+			if s.AddressType == "FQDN" {
+				addr.Hostname = a
+			} else {
+				addr.IP = a
+			}
+			if ep.Conditions.Ready == nil || *ep.Conditions.Ready {
+				sub.Addresses = append(sub.Addresses, addr)
+			} else {
+				sub.NotReadyAddresses = append(sub.NotReadyAddresses, addr)
+			}
+		}
+	}
+	return sub
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import "strconv"
+
+// An SRVRecord describes an endpoint in the shape of a DNS SRV record.
+type SRVRecord struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+// SRVRecords returns an SRV-like record for every selectable endpoint
+// serving the named port, or the default port if portName is empty.
+// Endpoints of lb have priority 0; endpoints of backup tiers added with
+// AddTier have priority 1, 2, ... in tier order. ErrNoEndpoints is returned
+// if no endpoint serves the port.
+func (lb *LoadBalancer) SRVRecords(portName string) ([]SRVRecord, error) {
+	lb.mu.RLock()
+	records := srvRecords(lb.selectableEndpoints(), portName, 0)
+	tiers := make([]tier, len(lb.tiers))
+	copy(tiers, lb.tiers)
+	lb.mu.RUnlock()
+
+	for i, t := range tiers {
+		t.lb.mu.RLock()
+		records = append(records, srvRecords(t.lb.selectableEndpoints(), portName, uint16(i+1))...)
+		t.lb.mu.RUnlock()
+	}
+	if len(records) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	return records, nil
+}
+
+func srvRecords(endpoints []Endpoint, portName string, priority uint16) []SRVRecord {
+	var records []SRVRecord
+	for _, ep := range endpoints {
+		port := ep.Port
+		if portName != "" {
+			port = ep.Ports[portName]
+		}
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			continue
+		}
+		weight := ep.Weight
+		if weight > 1<<16-1 {
+			weight = 1<<16 - 1
+		}
+		if weight < 0 {
+			weight = 0
+		}
+		records = append(records, SRVRecord{
+			Target:   ep.Host,
+			Port:     uint16(n),
+			Priority: priority,
+			Weight:   uint16(weight),
+		})
+	}
+	return records
+}
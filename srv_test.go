@@ -0,0 +1,53 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSRVRecords(t *testing.T) {
+	lb := newFromSubsets(&Config{WeightFunc: func(e Endpoint) int {
+		if e.Host == "10.0.0.2" {
+			return 5
+		}
+		return 1
+	}}, subset{
+		Addresses: addresses("10.0.0.1", "10.0.0.2"),
+		Ports:     []port{{Name: "http", Port: 8080}, {Name: "grpc", Port: 9000}},
+	})
+	backup := newStatic(&Config{}, Endpoint{Host: "10.1.0.1", Port: "80", Ports: map[string]string{"grpc": "9100"}, Weight: 1})
+	lb.AddTier(1, backup)
+
+	tests := []struct {
+		portName string
+		want     []SRVRecord
+	}{
+		{"grpc", []SRVRecord{
+			{Target: "10.0.0.1", Port: 9000, Priority: 0, Weight: 1},
+			{Target: "10.0.0.2", Port: 9000, Priority: 0, Weight: 5},
+			{Target: "10.1.0.1", Port: 9100, Priority: 1, Weight: 1},
+		}},
+		{"", []SRVRecord{
+			{Target: "10.0.0.1", Port: 8080, Priority: 0, Weight: 1},
+			{Target: "10.0.0.2", Port: 8080, Priority: 0, Weight: 5},
+			{Target: "10.1.0.1", Port: 80, Priority: 1, Weight: 1},
+		}},
+	}
+	for _, tt := range tests {
+		got, err := lb.SRVRecords(tt.portName)
+		if err != nil {
+			t.Fatalf("SRVRecords(%q) error = %v", tt.portName, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SRVRecords(%q) = %+v, want %+v", tt.portName, got, tt.want)
+		}
+	}
+
+	if _, err := lb.SRVRecords("admin"); err != ErrNoEndpoints {
+		t.Fatalf("SRVRecords(\"admin\") error = %v, want ErrNoEndpoints", err)
+	}
+}
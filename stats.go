@@ -0,0 +1,172 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// Stats is a snapshot of the state of a LoadBalancer. It can be marshaled
+// to JSON, for example to serve it from a debug handler.
+type Stats struct {
+	// EndpointCount is the number of current endpoints.
+	EndpointCount int
+
+	// OmittedEndpoints is the number of endpoints of the last update left
+	// out because of MaxEndpoints.
+	OmittedEndpoints int
+
+	// Synced reports whether the endpoints were synchronized with the
+	// Kubernetes API or set by Prime at least once. Until then Next returns
+	// ErrNotSynced.
+	Synced bool
+
+	// ServiceExists reports whether the Endpoints object of the service was
+	// found, as reported by LoadBalancer.ServiceExists.
+	ServiceExists bool
+
+	// Running reports whether background synchronization was started and
+	// the LoadBalancer has not been shut down.
+	Running bool
+
+	// LastSync is when the last successful list request completed or watch
+	// connection was established, or zero if none has been.
+	LastSync time.Time
+
+	// LastError is the message of the last error returned by a list
+	// request or watch connection attempt, or empty if none failed.
+	LastError string
+
+	// WatchReconnects is the number of times the endpoints watch was
+	// re-established after its first connection.
+	WatchReconnects int
+
+	// SubsetCount is the number of subsets in the last Endpoints object.
+	SubsetCount int
+
+	// ReadyCount and NotReadyCount are the number of ready and not-ready
+	// addresses across all subsets of the last Endpoints object.
+	ReadyCount    int
+	NotReadyCount int
+
+	// ConsecutiveFailures and ConsecutiveSuccesses are the number of list
+	// requests and watch connection attempts in a row that failed or
+	// succeeded. At most one of them is non-zero.
+	ConsecutiveFailures  int
+	ConsecutiveSuccesses int
+
+	// ParseError is the error that made the last list response or watch
+	// event undecodable, or nil if it was decoded. The endpoints are left
+	// unchanged by responses and events that fail to decode.
+	ParseError error
+}
+
+// Stats returns a snapshot of the state of the LoadBalancer.
+func (lb *LoadBalancer) Stats() Stats {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	stats := lb.stats
+	stats.EndpointCount = len(lb.endpoints)
+	stats.Synced = lb.synced
+	stats.ServiceExists = lb.serviceExists
+	return stats
+}
+
+// MarshalJSON encodes s with ParseError as its message, or null.
+func (s Stats) MarshalJSON() ([]byte, error) {
+	type stats Stats
+	v := struct {
+		stats
+		ParseError *string
+	}{stats: stats(s)}
+	if s.ParseError != nil {
+		msg := s.ParseError.Error()
+		v.ParseError = &msg
+	}
+	return json.Marshal(v)
+}
+
+// recordSync records the outcome of a list request or watch connection
+// attempt in the sync streaks of lb.stats.
+func (lb *LoadBalancer) recordSync(err error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if err != nil {
+		lb.stats.ConsecutiveFailures++
+		lb.stats.ConsecutiveSuccesses = 0
+		lb.stats.LastError = err.Error()
+	} else {
+		lb.stats.ConsecutiveSuccesses++
+		lb.stats.ConsecutiveFailures = 0
+		lb.stats.LastSync = lb.now()
+	}
+}
+
+// recordReconnect counts a re-established watch in lb.stats.
+func (lb *LoadBalancer) recordReconnect() {
+	lb.mu.Lock()
+	lb.stats.WatchReconnects++
+	lb.mu.Unlock()
+}
+
+// setRunning records whether background synchronization is running.
+func (lb *LoadBalancer) setRunning(running bool) {
+	lb.mu.Lock()
+	lb.stats.Running = running
+	lb.mu.Unlock()
+}
+
+// recordParse records the outcome of decoding a list response or watch
+// event. Errors that do not stem from malformed data, such as a closed
+// connection, are ignored.
+func (lb *LoadBalancer) recordParse(err error) {
+	if err != nil && !isParseError(err) {
+		return
+	}
+	lb.mu.Lock()
+	lb.stats.ParseError = err
+	lb.mu.Unlock()
+}
+
+func isParseError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var decodeErr *DecodeError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &decodeErr) || errors.As(err, &syntaxErr) || errors.As(err, &typeErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || strings.HasPrefix(err.Error(), "json: unknown field")
+}
+
+// recordShape records the shape of an Endpoints object in lb.stats.
+// lb.mu must be held.
+func (lb *LoadBalancer) recordShape(endpoints endpoints) {
+	lb.stats.SubsetCount = len(endpoints.Subsets)
+	lb.stats.ReadyCount = 0
+	lb.stats.NotReadyCount = 0
+	for _, subset := range endpoints.Subsets {
+		lb.stats.ReadyCount += len(subset.Addresses)
+		lb.stats.NotReadyCount += len(subset.NotReadyAddresses)
+	}
+}
+
+// PortCoverage returns the number of current endpoints serving each named
+// port. A port missing from the result is served by no endpoint.
+func (lb *LoadBalancer) PortCoverage() map[string]int {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	coverage := make(map[string]int)
+	for _, ep := range lb.endpoints {
+		for name := range ep.Ports {
+			coverage[name]++
+		}
+	}
+	return coverage
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestStatsShape(t *testing.T) {
+	api := newFakeAPI(t, endpointsObject("1",
+		subset{
+			Addresses:         addresses("10.0.0.1", "10.0.0.2"),
+			NotReadyAddresses: addresses("10.0.0.3"),
+			Ports:             []port{{Name: "http", Port: 8080}},
+		},
+		subset{
+			Addresses:         addresses("10.0.1.1"),
+			NotReadyAddresses: addresses("10.0.1.2", "10.0.1.3"),
+			Ports:             []port{{Name: "grpc", Port: 9000}},
+		},
+	))
+	lb := New(api.config())
+	if err := lb.SyncEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := lb.Stats()
+	if stats.SubsetCount != 2 || stats.ReadyCount != 3 || stats.NotReadyCount != 3 {
+		t.Fatalf("SubsetCount, ReadyCount, NotReadyCount = %d, %d, %d, want 2, 3, 3",
+			stats.SubsetCount, stats.ReadyCount, stats.NotReadyCount)
+	}
+
+	// Every address becoming not ready is visible at a glance.
+	api.setList(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, endpointsObject("2", subset{NotReadyAddresses: addresses("10.0.0.1"), Ports: []port{{Port: 80}}}))
+	})
+	if err := lb.SyncEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+	stats = lb.Stats()
+	if stats.SubsetCount != 1 || stats.ReadyCount != 0 || stats.NotReadyCount != 1 {
+		t.Fatalf("SubsetCount, ReadyCount, NotReadyCount = %d, %d, %d, want 1, 0, 1",
+			stats.SubsetCount, stats.ReadyCount, stats.NotReadyCount)
+	}
+}
+
+func TestPortCoverage(t *testing.T) {
+	lb := newFromSubsets(&Config{},
+		subset{Addresses: addresses("10.0.0.1", "10.0.0.2", "10.0.0.3"), Ports: []port{{Name: "http", Port: 8080}, {Name: "grpc", Port: 9000}}},
+		subset{Addresses: addresses("10.0.1.1"), Ports: []port{{Name: "http", Port: 8080}}},
+	)
+	want := map[string]int{"http": 4, "grpc": 3}
+	if got := lb.PortCoverage(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("PortCoverage() = %v, want %v", got, want)
+	}
+}
+
+func TestStatsStreaks(t *testing.T) {
+	api := newFakeAPI(t, endpointsObject("1"))
+	lb := New(api.config())
+	ok, failing := api.list, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusServiceUnavailable, "ServiceUnavailable", "down")
+	})
+
+	steps := []struct {
+		fail                bool
+		failures, successes int
+	}{
+		{true, 1, 0},
+		{true, 2, 0},
+		{true, 3, 0},
+		{false, 0, 1},
+		{false, 0, 2},
+		{true, 1, 0},
+		{false, 0, 1},
+	}
+	for i, step := range steps {
+		if step.fail {
+			api.setList(failing)
+		} else {
+			api.setList(ok)
+		}
+		lb.SyncEndpoints()
+		stats := lb.Stats()
+		if stats.ConsecutiveFailures != step.failures || stats.ConsecutiveSuccesses != step.successes {
+			t.Fatalf("step %d: ConsecutiveFailures, ConsecutiveSuccesses = %d, %d, want %d, %d",
+				i, stats.ConsecutiveFailures, stats.ConsecutiveSuccesses, step.failures, step.successes)
+		}
+	}
+}
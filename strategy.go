@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A Strategy selects an endpoint for a LoadBalancer configured with it.
+// Pick is called with the LoadBalancer locked and a non-empty slice of the
+// selectable endpoints, and must return one of them or an error. The slice
+// must not be retained or modified.
+type Strategy interface {
+	Pick(endpoints []Endpoint) (Endpoint, error)
+}
+
+// A ResultReporter is a Strategy that adapts to the outcome of requests.
+// LoadBalancer.ReportResult passes every result on to a configured Strategy
+// implementing it.
+type ResultReporter interface {
+	ReportResult(endpoint Endpoint, latency time.Duration, err error)
+}
+
+// RoundRobinStrategy selects endpoints in turn. Unlike the built-in
+// selection it ignores weights. The zero value is ready to use.
+type RoundRobinStrategy struct {
+	mu   sync.Mutex
+	next int
+}
+
+// Pick returns the endpoint after the one it returned last.
+func (s *RoundRobinStrategy) Pick(endpoints []Endpoint) (Endpoint, error) {
+	if len(endpoints) == 0 {
+		return Endpoint{}, ErrNoEndpoints
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next >= len(endpoints) {
+		s.next = 0
+	}
+	endpoint := endpoints[s.next]
+	s.next++
+	return endpoint, nil
+}
+
+// RandomStrategy selects endpoints uniformly at random.
+type RandomStrategy struct{}
+
+// Pick returns a random endpoint.
+func (RandomStrategy) Pick(endpoints []Endpoint) (Endpoint, error) {
+	if len(endpoints) == 0 {
+		return Endpoint{}, ErrNoEndpoints
+	}
+	return endpoints[rand.Intn(len(endpoints))], nil
+}
+
+// StrategyInfo describes how a LoadBalancer selects endpoints.
+type StrategyInfo struct {
+	// Name is the selection algorithm in use: "round-robin", or
+	// "weighted-round-robin" when endpoint weights differ or selection
+	// follows reported capacity. With a configured Strategy it is
+	// "round-robin", "random" or "adaptive-weight" for the strategies of
+	// this package, and "custom" otherwise.
+	Name string
+
+	// Weighted reports whether the current endpoints have differing
+	// weights.
+	Weighted bool
+
+	// ZoneBalance is the configured zone weighting mode.
+	ZoneBalance string
+
+	// HealthCheckInterval is the interval between active health checks,
+	// or zero if health checking is disabled.
+	HealthCheckInterval time.Duration
+
+	// MinStableDuration is how long new endpoints settle before selection.
+	MinStableDuration time.Duration
+}
+
+// Strategy reports the endpoint selection strategy currently in effect
+// and its parameters.
+func (lb *LoadBalancer) Strategy() StrategyInfo {
+	lb.mu.RLock()
+	weighted := lb.weighted
+	lb.mu.RUnlock()
+
+	info := StrategyInfo{
+		Name:              "round-robin",
+		Weighted:          weighted,
+		ZoneBalance:       lb.zoneBalance.String(),
+		MinStableDuration: lb.minStableDuration,
+	}
+	switch lb.strategy.(type) {
+	case nil:
+		if weighted || lb.capacityHeader != "" {
+			info.Name = "weighted-round-robin"
+		}
+	case *RoundRobinStrategy:
+	case RandomStrategy, *RandomStrategy:
+		info.Name = "random"
+	case *StrategyAdaptiveWeight:
+		info.Name = "adaptive-weight"
+	default:
+		info.Name = "custom"
+	}
+	if lb.healthCheck != nil {
+		info.HealthCheckInterval = lb.healthCheck.Interval
+	}
+	return info
+}
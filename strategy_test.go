@@ -0,0 +1,61 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"testing"
+	"time"
+)
+
+// firstStrategy is a custom Strategy always picking the first endpoint.
+type firstStrategy struct{}
+
+func (firstStrategy) Pick(endpoints []Endpoint) (Endpoint, error) {
+	return endpoints[0], nil
+}
+
+func TestStrategyInfo(t *testing.T) {
+	uneven := []Endpoint{weighted(ep("10.0.0.1", "80"), 1), weighted(ep("10.0.0.2", "80"), 3)}
+	even := []Endpoint{ep("10.0.0.1", "80"), ep("10.0.0.2", "80")}
+	tests := []struct {
+		name   string
+		config Config
+		eps    []Endpoint
+		want   StrategyInfo
+	}{
+		{"round-robin", Config{}, even, StrategyInfo{Name: "round-robin", ZoneBalance: "none"}},
+		{
+			"weighted",
+			Config{
+				ZoneBalance:       ProportionalToZoneSize,
+				HealthCheck:       &HealthCheck{Check: func(Endpoint) bool { return true }, Interval: time.Minute},
+				MinStableDuration: time.Second,
+				WeightFunc: func(e Endpoint) int {
+					if e.Host == "10.0.0.2" {
+						return 3
+					}
+					return 1
+				},
+			},
+			even,
+			StrategyInfo{
+				Name:                "weighted-round-robin",
+				Weighted:            true,
+				ZoneBalance:         "proportional-to-zone-size",
+				HealthCheckInterval: time.Minute,
+				MinStableDuration:   time.Second,
+			},
+		},
+		{"capacity", Config{CapacityHeader: "X-Capacity"}, even, StrategyInfo{Name: "weighted-round-robin", ZoneBalance: "none"}},
+		{"random", Config{Strategy: RandomStrategy{}}, uneven, StrategyInfo{Name: "random", Weighted: true, ZoneBalance: "none"}},
+		{"custom", Config{Strategy: firstStrategy{}}, even, StrategyInfo{Name: "custom", ZoneBalance: "none"}},
+	}
+	for _, tt := range tests {
+		lb := newStatic(&tt.config, tt.eps...)
+		if got := lb.Strategy(); got != tt.want {
+			t.Errorf("%s: Strategy() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"sync"
+	"time"
+)
+
+// SubscribeOptions configures a subscription created by Subscribe.
+type SubscribeOptions struct {
+	// MinInterval is the minimum time between two deliveries to the
+	// subscriber. Changes arriving sooner are coalesced and the latest set
+	// of endpoints is delivered once the interval has elapsed. If zero,
+	// every change is delivered as it happens.
+	MinInterval time.Duration
+}
+
+// Subscribe returns a channel that receives the current endpoints and then
+// the new set of endpoints every time it changes, throttled according to
+// opts. The channel holds only the latest set: a subscriber that falls
+// behind skips intermediate sets but always receives the final one. The
+// returned cancel function ends the subscription and closes the channel,
+// as does Shutdown.
+func (lb *LoadBalancer) Subscribe(opts SubscribeOptions) (<-chan []Endpoint, func()) {
+	s := &subscriber{
+		ch:          make(chan []Endpoint, 1),
+		minInterval: opts.MinInterval,
+	}
+
+	lb.subscribersMu.Lock()
+	if lb.subscribersClosed {
+		lb.subscribersMu.Unlock()
+		close(s.ch)
+		return s.ch, func() {}
+	}
+	if lb.subscribers == nil {
+		lb.subscribers = make(map[*subscriber]bool)
+	}
+	lb.subscribers[s] = true
+	// Delivering the current set under subscribersMu orders it before
+	// the notification of any later update.
+	s.notify(lb.Endpoints())
+	lb.subscribersMu.Unlock()
+
+	return s.ch, func() {
+		lb.subscribersMu.Lock()
+		delete(lb.subscribers, s)
+		lb.subscribersMu.Unlock()
+		s.close()
+	}
+}
+
+// AddListener registers f to be called like OnChange whenever the set of
+// endpoints changes. Listeners are called in the order they were added,
+// after OnChange.
+func (lb *LoadBalancer) AddListener(f func(old, new []Endpoint)) {
+	lb.subscribersMu.Lock()
+	lb.listeners = append(lb.listeners, f)
+	lb.subscribersMu.Unlock()
+}
+
+// notifyChange reports a change of the endpoints from old to endpoints to
+// OnChange, the listeners and the subscribers.
+func (lb *LoadBalancer) notifyChange(old, endpoints []Endpoint) {
+	endpoints = append([]Endpoint(nil), endpoints...)
+	if lb.onChange != nil {
+		lb.onChange(old, endpoints)
+	}
+
+	lb.subscribersMu.Lock()
+	listeners := lb.listeners
+	lb.subscribersMu.Unlock()
+	for _, f := range listeners {
+		f(old, endpoints)
+	}
+
+	lb.subscribersMu.Lock()
+	defer lb.subscribersMu.Unlock()
+	for s := range lb.subscribers {
+		s.notify(endpoints)
+	}
+}
+
+// closeSubscribers ends every subscription. Later calls to Subscribe return
+// a closed channel.
+func (lb *LoadBalancer) closeSubscribers() {
+	lb.subscribersMu.Lock()
+	defer lb.subscribersMu.Unlock()
+	for s := range lb.subscribers {
+		s.close()
+	}
+	lb.subscribers = nil
+	lb.subscribersClosed = true
+}
+
+type subscriber struct {
+	ch          chan []Endpoint
+	minInterval time.Duration
+
+	mu        sync.Mutex // protects the fields below
+	last      time.Time  // time of the last delivery
+	pending   []Endpoint // set waiting for the interval to elapse
+	scheduled bool       // a delivery of pending is scheduled
+	closed    bool
+}
+
+// notify delivers endpoints now, or schedules its delivery if the last one
+// was less than minInterval ago.
+func (s *subscriber) notify(endpoints []Endpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	wait := s.minInterval - time.Since(s.last)
+	if wait <= 0 && !s.scheduled {
+		s.deliver(endpoints)
+		return
+	}
+	s.pending = endpoints
+	if !s.scheduled {
+		s.scheduled = true
+		time.AfterFunc(wait, s.flush)
+	}
+}
+
+// flush delivers the pending set once the interval has elapsed.
+func (s *subscriber) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scheduled = false
+	if !s.closed {
+		s.deliver(s.pending)
+	}
+	s.pending = nil
+}
+
+// deliver replaces any set waiting in the channel with endpoints. s.mu must
+// be held.
+func (s *subscriber) deliver(endpoints []Endpoint) {
+	s.last = time.Now()
+	for {
+		select {
+		case s.ch <- endpoints:
+			return
+		default:
+		}
+		select {
+		case <-s.ch:
+		default:
+		}
+	}
+}
+
+func (s *subscriber) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// A delivery is a set of endpoints received from a subscription.
+type delivery struct {
+	at  time.Time
+	eps []Endpoint
+}
+
+// collect receives from ch until it is closed and then sends every
+// delivery on the returned channel.
+func collect(ch <-chan []Endpoint) <-chan []delivery {
+	result := make(chan []delivery, 1)
+	go func() {
+		var deliveries []delivery
+		for eps := range ch {
+			deliveries = append(deliveries, delivery{time.Now(), eps})
+		}
+		result <- deliveries
+	}()
+	return result
+}
+
+func TestSubscribeIntervals(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	lb := newStatic(&Config{}, ep("10.0.0.1", "80"))
+	fastCh, _ := lb.Subscribe(SubscribeOptions{})
+	slowCh, _ := lb.Subscribe(SubscribeOptions{MinInterval: interval})
+	fast, slow := collect(fastCh), collect(slowCh)
+
+	start := time.Now()
+	var eps []Endpoint
+	for i := 1; i <= 10; i++ {
+		eps = append(eps, ep(fmt.Sprintf("10.0.1.%d", i), "80"))
+		lb.Prime(eps)
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(2*interval - time.Since(start))
+	lb.Shutdown()
+
+	fastDeliveries, slowDeliveries := <-fast, <-slow
+	if n := len(fastDeliveries); n < 5 {
+		t.Fatalf("unthrottled subscriber received %d deliveries for 10 updates, want most of them", n)
+	}
+	if n := len(slowDeliveries); n != 2 {
+		t.Fatalf("subscriber with a %v interval received %d deliveries, want the initial and the final set", interval, n)
+	}
+	if gap := slowDeliveries[1].at.Sub(slowDeliveries[0].at); gap < interval-10*time.Millisecond {
+		t.Fatalf("throttled deliveries %v apart, want at least %v", gap, interval)
+	}
+	for name, deliveries := range map[string][]delivery{"unthrottled": fastDeliveries, "throttled": slowDeliveries} {
+		if got := deliveries[len(deliveries)-1].eps; len(got) != 10 {
+			t.Errorf("%s subscriber's last delivery has %d endpoints, want the final 10", name, len(got))
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import "time"
+
+// ewmaWeight is the weight given to the newest sample in the moving
+// averages kept per endpoint.
+const ewmaWeight = 0.3
+
+// EndpointStats holds the telemetry recorded for an endpoint.
+type EndpointStats struct {
+	Endpoint Endpoint
+
+	// Selections is the number of times the endpoint was selected.
+	Selections uint64
+
+	// Latency is a moving average of the latencies passed to ReportResult.
+	Latency time.Duration
+
+	// ErrorRate is a moving average, between 0 and 1, of the share of
+	// results passed to ReportResult that were failures.
+	ErrorRate float64
+
+	// ConsecutiveFailures is the number of failures reported since the
+	// last success.
+	ConsecutiveFailures int
+
+	// ProbeLatency is the duration of the last successful health probe,
+	// or zero if the endpoint has not been probed successfully.
+	ProbeLatency time.Duration
+
+	// Capacity is the remaining capacity last reported through
+	// CapacityHeader, or -1 if none was reported.
+	Capacity int
+}
+
+// EndpointStats returns the telemetry recorded for every current endpoint.
+func (lb *LoadBalancer) EndpointStats() []EndpointStats {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	stats := make([]EndpointStats, len(lb.endpoints))
+	for i, ep := range lb.endpoints {
+		stats[i] = lb.endpointStatsOf(ep)
+	}
+	return stats
+}
+
+// StrategyHealthLatency orders endpoints by the latency of their last
+// health probe, fastest first, for use with NextBest. Endpoints that were
+// not probed sort last and ties go to the least selected endpoint, so
+// equally fast endpoints share the load.
+func StrategyHealthLatency(a, b EndpointStats) bool {
+	switch {
+	case a.ProbeLatency == b.ProbeLatency:
+		return a.Selections < b.Selections
+	case a.ProbeLatency == 0:
+		return false
+	case b.ProbeLatency == 0:
+		return true
+	}
+	return a.ProbeLatency < b.ProbeLatency
+}
+
+// ReportResult records the outcome of a request made to endpoint. A nil
+// err reports a success. The result is passed on to the configured
+// Strategy if it is a ResultReporter.
+func (lb *LoadBalancer) ReportResult(endpoint Endpoint, latency time.Duration, err error) {
+	if r, ok := lb.strategy.(ResultReporter); ok {
+		r.ReportResult(endpoint, latency, err)
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	s := lb.statsFor(endpoint)
+	if s == nil {
+		return
+	}
+	if s.Latency == 0 {
+		s.Latency = latency
+	} else {
+		s.Latency = time.Duration(ewmaWeight*float64(latency) + (1-ewmaWeight)*float64(s.Latency))
+	}
+	failure := 0.0
+	if err != nil {
+		failure = 1
+		s.ConsecutiveFailures++
+	} else {
+		s.ConsecutiveFailures = 0
+	}
+	s.ErrorRate = ewmaWeight*failure + (1-ewmaWeight)*s.ErrorRate
+}
+
+// NextBest returns the selectable endpoint whose stats sort first
+// according to less, allowing custom selection policies based on the
+// telemetry recorded for each endpoint.
+func (lb *LoadBalancer) NextBest(less func(a, b EndpointStats) bool) (Endpoint, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if err := lb.unavailable(); err != nil {
+		return Endpoint{}, err
+	}
+	lb.updateLocality()
+
+	var best EndpointStats
+	found := false
+	for _, ep := range lb.endpoints {
+		if !lb.selectable(ep) {
+			continue
+		}
+		s := lb.endpointStatsOf(ep)
+		if !found || less(s, best) {
+			best = s
+			found = true
+		}
+	}
+	if !found {
+		return Endpoint{}, ErrNoEndpoints
+	}
+	return lb.selected(best.Endpoint, nil)
+}
+
+// leastBad returns the current endpoint with the lowest error rate,
+// breaking ties by the fewest consecutive failures, among those accept
+// returns true for, or all if accept is nil. Endpoints with a weight of
+// zero are never returned. lb.mu must be held.
+func (lb *LoadBalancer) leastBad(accept func(Endpoint) bool) (Endpoint, bool) {
+	var best EndpointStats
+	found := false
+	for _, ep := range lb.endpoints {
+		if ep.Weight <= 0 || (accept != nil && !accept(ep)) {
+			continue
+		}
+		s := lb.endpointStatsOf(ep)
+		if !found || s.ErrorRate < best.ErrorRate ||
+			s.ErrorRate == best.ErrorRate && s.ConsecutiveFailures < best.ConsecutiveFailures {
+			best = s
+			found = true
+		}
+	}
+	return best.Endpoint, found
+}
+
+// selected records a successful selection of endpoint and passes its
+// arguments through. lb.mu must be held.
+func (lb *LoadBalancer) selected(endpoint Endpoint, err error) (Endpoint, error) {
+	if err == nil {
+		if s := lb.statsFor(endpoint); s != nil {
+			s.Selections++
+		}
+	}
+	return endpoint, err
+}
+
+// statsFor returns the mutable stats of a current endpoint, or nil if the
+// endpoint is not current. lb.mu must be held.
+func (lb *LoadBalancer) statsFor(endpoint Endpoint) *EndpointStats {
+	key := endpoint.key()
+	if s, ok := lb.endpointStats[key]; ok {
+		return s
+	}
+	for _, ep := range lb.endpoints {
+		if ep.key() == key {
+			if lb.endpointStats == nil {
+				lb.endpointStats = make(map[string]*EndpointStats)
+			}
+			s := &EndpointStats{Endpoint: ep, Capacity: -1}
+			lb.endpointStats[key] = s
+			return s
+		}
+	}
+	return nil
+}
+
+// endpointStatsOf returns a copy of the stats of endpoint. lb.mu must be
+// held.
+func (lb *LoadBalancer) endpointStatsOf(endpoint Endpoint) EndpointStats {
+	if s, ok := lb.endpointStats[endpoint.key()]; ok {
+		stats := *s
+		stats.Endpoint = endpoint
+		return stats
+	}
+	return EndpointStats{Endpoint: endpoint, Capacity: -1}
+}
+
+// SelectionCounts returns the number of times each current endpoint was
+// selected, keyed by "host:port".
+func (lb *LoadBalancer) SelectionCounts() map[string]uint64 {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	counts := make(map[string]uint64, len(lb.endpoints))
+	for _, ep := range lb.endpoints {
+		counts[ep.key()] = lb.endpointStatsOf(ep).Selections
+	}
+	return counts
+}
+
+// Fairness returns Jain's fairness index over the selection counts of the
+// current endpoints. It ranges from 1/n, when a single endpoint received
+// every selection, to 1.0 when selections are perfectly even. It returns
+// 1.0 when there were no selections.
+func (lb *LoadBalancer) Fairness() float64 {
+	var sum, sumSquares float64
+	counts := lb.SelectionCounts()
+	for _, c := range counts {
+		x := float64(c)
+		sum += x
+		sumSquares += x * x
+	}
+	if sumSquares == 0 {
+		return 1
+	}
+	return sum * sum / (float64(len(counts)) * sumSquares)
+}
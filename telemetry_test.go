@@ -0,0 +1,111 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNextBestLowestErrorRate(t *testing.T) {
+	a, b, c := ep("10.0.0.1", "80"), ep("10.0.0.2", "80"), ep("10.0.0.3", "80")
+	lb := newStatic(&Config{}, a, b, c)
+	failed := errors.New("failed")
+	for i := 0; i < 4; i++ {
+		lb.ReportResult(a, time.Millisecond, failed)
+		lb.ReportResult(b, time.Millisecond, nil)
+		lb.ReportResult(c, time.Millisecond, nil)
+	}
+	lb.ReportResult(c, time.Millisecond, failed)
+
+	lowestErrorRate := func(x, y EndpointStats) bool { return x.ErrorRate < y.ErrorRate }
+	for i := 0; i < 3; i++ {
+		got, err := lb.NextBest(lowestErrorRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Host != b.Host {
+			t.Fatalf("NextBest() = %s, want %s with the lowest error rate", got.Host, b.Host)
+		}
+	}
+	if got := lb.SelectionCounts()[b.key()]; got != 3 {
+		t.Fatalf("selections of %s = %d, want 3", b.Host, got)
+	}
+
+	if _, err := newStatic(&Config{}).NextBest(lowestErrorRate); err != ErrNoEndpoints {
+		t.Fatalf("NextBest() error = %v without endpoints, want ErrNoEndpoints", err)
+	}
+}
+
+func TestFairness(t *testing.T) {
+	eps := []Endpoint{ep("10.0.0.1", "80"), ep("10.0.0.2", "80"), ep("10.0.0.3", "80"), ep("10.0.0.4", "80")}
+
+	even := newStatic(&Config{}, eps...)
+	if got := even.Fairness(); got != 1 {
+		t.Fatalf("Fairness() = %v without selections, want 1", got)
+	}
+	for i := 0; i < 40; i++ {
+		even.Next()
+	}
+	if got := even.Fairness(); math.Abs(got-1) > 1e-9 {
+		t.Fatalf("Fairness() = %v after round-robin, want 1", got)
+	}
+
+	// Every selection of the same key goes to one endpoint.
+	skewed := newStatic(&Config{}, eps...)
+	for i := 0; i < 40; i++ {
+		skewed.Pick("user")
+	}
+	if got := skewed.Fairness(); math.Abs(got-0.25) > 1e-9 {
+		t.Fatalf("Fairness() = %v with one endpoint selected, want 1/4", got)
+	}
+	for i := 0; i < 40; i++ {
+		skewed.Next()
+	}
+	// Counts of 50, 10, 10 and 10 give 80² / (4 * 2800).
+	if got, want := skewed.Fairness(), 6400.0/11200; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("Fairness() = %v with skewed selections, want %v", got, want)
+	}
+}
+
+func TestStrategyHealthLatency(t *testing.T) {
+	slow, fast := ep("10.0.0.1", "80"), ep("10.0.0.2", "80")
+	lb := newStatic(&Config{HealthCheck: &HealthCheck{Check: func(e Endpoint) bool {
+		if e.Host == slow.Host {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return true
+	}}}, slow, fast)
+
+	// Endpoints not yet probed share the load.
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		got, err := lb.NextBest(StrategyHealthLatency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[got.Host] = true
+	}
+	if len(seen) != 2 {
+		t.Fatalf("NextBest() returned %v before probing, want both endpoints", seen)
+	}
+
+	lb.probeEndpoints()
+	stats := lb.EndpointStats()
+	if stats[0].ProbeLatency < 20*time.Millisecond || stats[1].ProbeLatency >= stats[0].ProbeLatency {
+		t.Fatalf("probe latencies = %v, %v, want the first one slower", stats[0].ProbeLatency, stats[1].ProbeLatency)
+	}
+	for i := 0; i < 4; i++ {
+		got, err := lb.NextBest(StrategyHealthLatency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Host != fast.Host {
+			t.Fatalf("NextBest() = %s, want the faster probing %s", got.Host, fast.Host)
+		}
+	}
+}
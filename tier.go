@@ -0,0 +1,87 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import "sort"
+
+// A tier is a backup pool of endpoints served by another LoadBalancer.
+type tier struct {
+	priority int
+	lb       *LoadBalancer
+}
+
+// AddTier adds the endpoints of other as a backup tier. The endpoints of lb
+// form the primary tier. While the primary tier has fewer than MinEndpoints
+// selectable endpoints, Next also selects from backup tiers in ascending
+// priority order until enough endpoints are available. The caller remains
+// responsible for synchronizing and shutting down other.
+func (lb *LoadBalancer) AddTier(priority int, other *LoadBalancer) {
+	lb.mu.Lock()
+	lb.tiers = append(lb.tiers, tier{priority, other})
+	sort.SliceStable(lb.tiers, func(i, j int) bool {
+		return lb.tiers[i].priority < lb.tiers[j].priority
+	})
+	lb.mu.Unlock()
+}
+
+// nextTiered returns the next endpoint, spilling over into backup tiers
+// when the primary tier is too small. lb.mu must not be held.
+func (lb *LoadBalancer) nextTiered() (Endpoint, error) {
+	lb.mu.Lock()
+	if err := lb.unavailable(); err != nil {
+		lb.mu.Unlock()
+		return Endpoint{}, err
+	}
+	lb.updateLocality()
+	candidates := lb.selectableEndpoints()
+	if len(candidates) >= lb.minEndpoints {
+		defer lb.mu.Unlock()
+		return lb.selected(lb.next())
+	}
+	tiers := make([]tier, len(lb.tiers))
+	copy(tiers, lb.tiers)
+	lb.mu.Unlock()
+
+	// Other LoadBalancers are consulted without holding lb.mu so that
+	// tiers referring to each other cannot deadlock.
+	for _, t := range tiers {
+		t.lb.mu.RLock()
+		candidates = append(candidates, t.lb.selectableEndpoints()...)
+		t.lb.mu.RUnlock()
+		if len(candidates) >= lb.minEndpoints {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		return lb.selected(lb.next())
+	}
+
+	lb.mu.Lock()
+	i := lb.tierCursor % len(candidates)
+	lb.tierCursor = (i + 1) % len(candidates)
+	endpoint := candidates[i]
+	lb.mu.Unlock()
+	return endpoint, nil
+}
+
+// selectableEndpoints returns the endpoints Next may select. lb.mu must be
+// held.
+func (lb *LoadBalancer) selectableEndpoints() []Endpoint {
+	return lb.candidates(nil)
+}
+
+// candidates returns the selectable endpoints accept returns true for, or
+// all selectable endpoints if accept is nil. lb.mu must be held.
+func (lb *LoadBalancer) candidates(accept func(Endpoint) bool) []Endpoint {
+	var eps []Endpoint
+	for _, ep := range lb.endpoints {
+		if lb.eligible(ep, accept) {
+			eps = append(eps, ep)
+		}
+	}
+	return eps
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import "testing"
+
+// nextHosts returns the set of hosts returned by n calls to lb.Next.
+func nextHosts(t *testing.T, lb *LoadBalancer, n int) map[string]bool {
+	t.Helper()
+	hosts := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		got, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts[got.Host] = true
+	}
+	return hosts
+}
+
+func TestTierSpillover(t *testing.T) {
+	primary := newStatic(&Config{MinEndpoints: 2}, ep("10.0.0.1", "80"), ep("10.0.0.2", "80"), ep("10.0.0.3", "80"))
+	backup := newStatic(&Config{}, ep("10.1.0.1", "80"), ep("10.1.0.2", "80"))
+	primary.AddTier(1, backup)
+
+	if hosts := nextHosts(t, primary, 12); len(hosts) != 3 || hosts["10.1.0.1"] || hosts["10.1.0.2"] {
+		t.Fatalf("Next() returned %v with a full primary tier, want only primary endpoints", hosts)
+	}
+
+	primary.Prime([]Endpoint{ep("10.0.0.1", "80"), ep("10.0.0.2", "80")})
+	if hosts := nextHosts(t, primary, 12); len(hosts) != 2 || !hosts["10.0.0.1"] || !hosts["10.0.0.2"] {
+		t.Fatalf("Next() returned %v with the primary tier at MinEndpoints, want only primary endpoints", hosts)
+	}
+
+	primary.Prime([]Endpoint{ep("10.0.0.1", "80")})
+	hosts := nextHosts(t, primary, 12)
+	if !hosts["10.0.0.1"] || !hosts["10.1.0.1"] || !hosts["10.1.0.2"] {
+		t.Fatalf("Next() returned %v below MinEndpoints, want the primary and backup endpoints", hosts)
+	}
+}
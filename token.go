@@ -0,0 +1,52 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenRefreshInterval is how long a token read from BearerTokenFile is
+// used before the file is read again.
+const tokenRefreshInterval = time.Minute
+
+// tokenCache holds the token last read from BearerTokenFile.
+type tokenCache struct {
+	mu     sync.Mutex
+	token  string
+	readAt time.Time
+}
+
+// token returns the bearer token to authenticate API requests with, or ""
+// if none is configured. If the token file cannot be read again, the token
+// read last is used.
+func (lb *LoadBalancer) token() (string, error) {
+	if lb.bearerTokenFile == "" {
+		return lb.bearerToken, nil
+	}
+
+	c := &lb.tokenCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Since(c.readAt) < tokenRefreshInterval {
+		return c.token, nil
+	}
+
+	data, err := ioutil.ReadFile(lb.bearerTokenFile)
+	if err != nil {
+		if c.token != "" {
+			lb.logError(errors.New("endpoints: "+err.Error()), "endpoints token read failed", "path", lb.bearerTokenFile)
+			return c.token, nil
+		}
+		return "", errors.New("endpoints: " + err.Error())
+	}
+	c.token = strings.TrimSpace(string(data))
+	c.readAt = time.Now()
+	return c.token, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+)
+
+// maxTransportAttempts bounds how many endpoints a single request is tried
+// against when RetryNextOnError is set.
+const maxTransportAttempts = 3
+
+// Transport returns an http.RoundTripper that sends every request to the
+// next endpoint by replacing the host and port of the request URL. Requests
+// are performed using http.DefaultTransport.
+//
+// If RequestTimeout is set each attempt is bounded by it, independently of
+// the request context. If RetryNextOnError is set a failed attempt is
+// retried against the next endpoint it has not failed against, provided
+// the request body can be replayed. If MaxLeasesPerEndpoint is set each
+// attempt holds a lease on its endpoint until the response body is closed.
+// If CapacityHeader is set the capacity reported in each response is
+// recorded for its endpoint.
+func (lb *LoadBalancer) Transport() http.RoundTripper {
+	attempts := 1
+	if lb.retryNextOnError {
+		attempts = maxTransportAttempts
+	}
+	return &transport{lb: lb, base: http.DefaultTransport, attempts: attempts}
+}
+
+type transport struct {
+	lb       *LoadBalancer
+	base     http.RoundTripper
+	attempts int              // maximum attempts per request
+	retry    func(error) bool // reports whether to retry after err; nil retries any error
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := 1
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		attempts = t.attempts
+	}
+
+	var err error
+	var failed []Endpoint
+	for i := 0; i < attempts; i++ {
+		var endpoint Endpoint
+		var release func()
+		endpoint, release, err = t.lb.nextLease(failed...)
+		if err != nil {
+			if len(failed) > 0 {
+				break
+			}
+			return nil, err
+		}
+
+		var resp *http.Response
+		resp, err = t.roundTrip(req, endpoint, release, i > 0)
+		if err == nil {
+			return resp, nil
+		}
+		if req.Context().Err() != nil || (t.retry != nil && !t.retry(err)) {
+			break
+		}
+		failed = append(failed, endpoint)
+	}
+	return nil, err
+}
+
+// roundTrip performs a single attempt of req against endpoint, calling
+// release once the attempt is over.
+func (t *transport) roundTrip(req *http.Request, endpoint Endpoint, release func(), replay bool) (*http.Response, error) {
+	ctx, cancelCtx := req.Context(), context.CancelFunc(func() {})
+	if t.lb.requestTimeout > 0 {
+		ctx, cancelCtx = context.WithTimeout(ctx, t.lb.requestTimeout)
+	}
+	cancel := func() {
+		cancelCtx()
+		release()
+	}
+
+	r := req.Clone(ctx)
+	r.URL.Host = net.JoinHostPort(endpoint.Host, endpoint.Port)
+	if replay && req.GetBody != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		r.Body = body
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if t.lb.capacityHeader != "" {
+		if v := resp.Header.Get(t.lb.capacityHeader); v != "" {
+			if capacity, err := t.lb.parseCapacity(v); err == nil {
+				t.lb.recordCapacity(endpoint, capacity)
+			}
+		}
+	}
+
+	// The attempt context and lease must outlive RoundTrip until the body
+	// is read.
+	resp.Body = &cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelBody releases the context and lease of a request attempt when the
+// response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
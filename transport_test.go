@@ -0,0 +1,144 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backend starts a server running handler and returns its endpoint.
+func backend(t *testing.T, handler http.HandlerFunc) Endpoint {
+	s := httptest.NewServer(handler)
+	t.Cleanup(s.Close)
+	host, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ep(host, port)
+}
+
+func TestTransportRetriesHangingBackend(t *testing.T) {
+	hanging := backend(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	healthy := backend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	lb := newStatic(&Config{RequestTimeout: 50 * time.Millisecond, RetryNextOnError: true}, hanging, healthy)
+	client := &http.Client{Transport: lb.Transport()}
+	// Every other request is sent to the hanging backend first.
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get("http://service/")
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "ok" {
+			t.Fatalf("request %d: body = %q, %v, want ok", i, body, err)
+		}
+	}
+
+	lb = newStatic(&Config{RequestTimeout: 50 * time.Millisecond}, hanging, healthy)
+	client = &http.Client{Transport: lb.Transport()}
+	failures := 0
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://service/")
+		if err != nil {
+			failures++
+			continue
+		}
+		resp.Body.Close()
+	}
+	if failures != 1 {
+		t.Fatalf("%d of 2 requests failed without RetryNextOnError, want the 1 sent to the hanging backend", failures)
+	}
+}
+
+func TestTransportCapacityHeader(t *testing.T) {
+	reporting := func(capacity string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Capacity", capacity)
+		}
+	}
+	low := backend(t, reporting("1%"))
+	high := backend(t, reporting("10%"))
+	lb := newStatic(&Config{
+		CapacityHeader: "X-Capacity",
+		ParseCapacity:  func(v string) (int, error) { return strconv.Atoi(strings.TrimSuffix(v, "%")) },
+	}, low, high)
+
+	client := &http.Client{Transport: lb.Transport()}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://service/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 110; i++ {
+		got, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[got.Port]++
+	}
+	if counts[low.Port] != 10 || counts[high.Port] != 100 {
+		t.Fatalf("selections = %d low, %d high capacity, want 10 and 100", counts[low.Port], counts[high.Port])
+	}
+}
+
+func TestTransportMaxLeases(t *testing.T) {
+	named := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", name)
+		}
+	}
+	a, b := backend(t, named("a")), backend(t, named("b"))
+	lb := newStatic(&Config{MaxLeasesPerEndpoint: 1}, a, b)
+	client := &http.Client{Transport: lb.Transport()}
+
+	// The first response holds the lease on its backend until its body is
+	// closed.
+	held, err := client.Get("http://service/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saturated := held.Header.Get("X-Backend")
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get("http://service/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Backend"); got == saturated {
+			t.Fatalf("request %d was sent to saturated backend %s", i, got)
+		}
+	}
+
+	held.Body.Close()
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get("http://service/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		seen[resp.Header.Get("X-Backend")] = true
+	}
+	if !seen[saturated] {
+		t.Fatalf("no request was sent to backend %s after its lease was released", saturated)
+	}
+}
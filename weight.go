@@ -0,0 +1,161 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+// maxZoneWeight bounds the weights computed for EvenAcrossZones. Beyond it
+// weights are scaled down and rounded.
+const maxZoneWeight = 1000
+
+// ZoneBalance determines how endpoint weights account for the number of
+// endpoints in each topology zone.
+type ZoneBalance int
+
+const (
+	// ZoneBalanceNone leaves endpoint weights unchanged.
+	ZoneBalanceNone ZoneBalance = iota
+
+	// EvenAcrossZones gives every zone the same share of traffic, so each
+	// endpoint in a zone with fewer endpoints receives more traffic.
+	EvenAcrossZones
+
+	// ProportionalToZoneSize gives every endpoint the same share of
+	// traffic, so each zone receives traffic in proportion to its size.
+	ProportionalToZoneSize
+)
+
+func (z ZoneBalance) String() string {
+	switch z {
+	case ZoneBalanceNone:
+		return "none"
+	case EvenAcrossZones:
+		return "even-across-zones"
+	case ProportionalToZoneSize:
+		return "proportional-to-zone-size"
+	}
+	return "unknown"
+}
+
+// updateLocality restricts selection to endpoints in the local zone if any
+// of them is selectable, and lifts the restriction otherwise. lb.mu must be
+// held.
+func (lb *LoadBalancer) updateLocality() {
+	lb.localOnly = false
+	if lb.localZone == "" {
+		return
+	}
+	for _, ep := range lb.endpoints {
+		if ep.Zone == lb.localZone && lb.selectable(ep) {
+			lb.localOnly = true
+			return
+		}
+	}
+}
+
+// applyZoneBalance sets the Weight of every endpoint according to mode
+// and the number of endpoints in its zone. Endpoints without a zone are
+// counted as a zone of their own.
+func applyZoneBalance(endpoints []Endpoint, mode ZoneBalance) {
+	switch mode {
+	case EvenAcrossZones:
+		sizes := make(map[string]int)
+		for _, ep := range endpoints {
+			sizes[ep.Zone]++
+		}
+		multiple := 1
+		for _, n := range sizes {
+			multiple = lcm(multiple, n)
+			if multiple > maxZoneWeight {
+				break
+			}
+		}
+		for i := range endpoints {
+			n := sizes[endpoints[i].Zone]
+			if multiple <= maxZoneWeight {
+				endpoints[i].Weight = multiple / n
+			} else {
+				endpoints[i].Weight = (maxZoneWeight + n/2) / n
+			}
+			if endpoints[i].Weight < 1 {
+				endpoints[i].Weight = 1
+			}
+		}
+	case ProportionalToZoneSize:
+		for i := range endpoints {
+			endpoints[i].Weight = 1
+		}
+	}
+}
+
+func lcm(a, b int) int {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
+
+// uniformWeights reports whether every endpoint has the same weight, in
+// which case selection does not need to consider weights.
+func uniformWeights(endpoints []Endpoint) bool {
+	for _, ep := range endpoints {
+		if ep.Weight != endpoints[0].Weight {
+			return false
+		}
+	}
+	return true
+}
+
+// weight returns the effective weight of endpoint, scaling its Weight by
+// the capacity it last reported. lb.mu must be held.
+func (lb *LoadBalancer) weight(endpoint Endpoint) int {
+	if s, ok := lb.endpointStats[endpoint.key()]; ok && s.Capacity > 1 {
+		return endpoint.Weight * s.Capacity
+	}
+	return endpoint.Weight
+}
+
+// recordCapacity records the remaining capacity reported by endpoint.
+func (lb *LoadBalancer) recordCapacity(endpoint Endpoint, capacity int) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if s := lb.statsFor(endpoint); s != nil {
+		s.Capacity = capacity
+	}
+}
+
+// nextWeighted returns the next endpoint using smooth weighted round-robin,
+// which interleaves endpoints in proportion to their weights rather than
+// returning each endpoint several times in a row. Only endpoints accept
+// returns true for are considered, or all if accept is nil. lb.mu must be
+// held.
+func (lb *LoadBalancer) nextWeighted(accept func(Endpoint) bool) (Endpoint, error) {
+	if lb.currentWeights == nil {
+		lb.currentWeights = make(map[string]int)
+	}
+
+	total := 0
+	best := -1
+	bestWeight := 0
+	for i, ep := range lb.endpoints {
+		weight := lb.weight(ep)
+		if weight <= 0 || !lb.eligible(ep, accept) {
+			continue
+		}
+		key := ep.key()
+		lb.currentWeights[key] += weight
+		total += weight
+		if best < 0 || lb.currentWeights[key] > bestWeight {
+			best = i
+			bestWeight = lb.currentWeights[key]
+		}
+	}
+	if best < 0 {
+		return Endpoint{}, ErrNoEndpoints
+	}
+
+	endpoint := lb.endpoints[best]
+	lb.currentWeights[endpoint.key()] -= total
+	return endpoint, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package endpoints
+
+import (
+	"strings"
+	"testing"
+)
+
+// zoned returns endpoint with its Zone set to zone.
+func zoned(endpoint Endpoint, zone string) Endpoint {
+	endpoint.Zone = zone
+	return endpoint
+}
+
+func TestZoneBalance(t *testing.T) {
+	eps := []Endpoint{
+		zoned(ep("10.0.0.1", "80"), "a"),
+		zoned(ep("10.0.0.2", "80"), "b"),
+		zoned(ep("10.0.0.3", "80"), "b"),
+		zoned(ep("10.0.0.4", "80"), "b"),
+	}
+	tests := []struct {
+		mode    ZoneBalance
+		weights map[string]int
+		zoneA   int // selections of zone a out of 60
+	}{
+		{EvenAcrossZones, map[string]int{"a": 3, "b": 1}, 30},
+		{ProportionalToZoneSize, map[string]int{"a": 1, "b": 1}, 15},
+	}
+	for _, tt := range tests {
+		lb := newStatic(&Config{ZoneBalance: tt.mode}, eps...)
+		for _, e := range lb.Endpoints() {
+			if e.Weight != tt.weights[e.Zone] {
+				t.Errorf("%v: endpoint %s in zone %s has weight %d, want %d", tt.mode, e.Host, e.Zone, e.Weight, tt.weights[e.Zone])
+			}
+		}
+		zoneA := 0
+		for i := 0; i < 60; i++ {
+			got, err := lb.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Zone == "a" {
+				zoneA++
+			}
+		}
+		if zoneA != tt.zoneA {
+			t.Errorf("%v: zone a received %d of 60 selections, want %d", tt.mode, zoneA, tt.zoneA)
+		}
+	}
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	weights := map[string]int{"10.0.0.1": 5, "10.0.0.2": 1, "10.0.0.3": 1, "10.0.0.4": 0}
+	lb := newStatic(&Config{WeightFunc: func(e Endpoint) int { return weights[e.Host] }},
+		ep("10.0.0.1", "80"), ep("10.0.0.2", "80"), ep("10.0.0.3", "80"), ep("10.0.0.4", "80"))
+
+	counts := make(map[string]int)
+	var sequence []string
+	for i := 0; i < 700; i++ {
+		got, err := lb.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[got.Host]++
+		if i < 7 {
+			sequence = append(sequence, got.Host[len(got.Host)-1:])
+		}
+	}
+	for host, weight := range weights {
+		if want := weight * 100; counts[host] != want {
+			t.Errorf("%s with weight %d selected %d times of 700, want %d", host, weight, counts[host], want)
+		}
+	}
+	// Smooth weighted round-robin interleaves the lighter endpoints with
+	// the heavy one instead of repeating it five times in a row.
+	if got, want := strings.Join(sequence, " "), "1 1 2 1 3 1 1"; got != want {
+		t.Errorf("first selections = %s, want %s", got, want)
+	}
+}
+
+func TestLocalZoneFallback(t *testing.T) {
+	zones := map[string]string{"node-1": "a", "node-2": "b", "node-3": "c"}
+	fixture := subset{
+		Addresses: []address{
+			{IP: "10.0.0.1", NodeName: "node-1"},
+			{IP: "10.0.0.2", NodeName: "node-2"},
+			{IP: "10.0.0.3", NodeName: "node-2"},
+			{IP: "10.0.0.4", NodeName: "node-3"},
+		},
+		Ports: []port{{Port: 80}},
+	}
+	var down string
+	newLB := func(localZone string) *LoadBalancer {
+		return newFromSubsets(&Config{
+			LocalZone:   localZone,
+			NodeZone:    func(node string) string { return zones[node] },
+			HealthCheck: &HealthCheck{Check: func(e Endpoint) bool { return e.Host != down }},
+		}, fixture)
+	}
+
+	lb := newLB("b")
+	for _, e := range lb.Endpoints() {
+		if e.Zone != zones[e.NodeName] {
+			t.Fatalf("endpoint %s on %s has Zone %q, want %q", e.Host, e.NodeName, e.Zone, zones[e.NodeName])
+		}
+	}
+	if hosts := nextHosts(t, lb, 8); len(hosts) != 2 || !hosts["10.0.0.2"] || !hosts["10.0.0.3"] {
+		t.Fatalf("Next() returned %v, want only the endpoints in local zone b", hosts)
+	}
+
+	// Once no local endpoint is selectable, every zone is used.
+	down = "10.0.0.1"
+	lb = newLB("a")
+	if hosts := nextHosts(t, lb, 8); len(hosts) != 1 || !hosts["10.0.0.1"] {
+		t.Fatalf("Next() returned %v, want only the local endpoint before it is ejected", hosts)
+	}
+	lb.probeEndpoints()
+	if hosts := nextHosts(t, lb, 9); len(hosts) != 3 || hosts["10.0.0.1"] {
+		t.Fatalf("Next() returned %v with the local endpoint ejected, want every other zone", hosts)
+	}
+
+	if hosts := nextHosts(t, newLB("d"), 8); len(hosts) != 4 {
+		t.Fatalf("Next() returned %v without local endpoints, want all zones", hosts)
+	}
+}